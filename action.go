@@ -0,0 +1,122 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import "fmt"
+
+// Action registers fn to compute the value of the nodes matched by rule,
+// a nil fn removes the action, it must not be called while parsing
+func (p *Parser) Action(rule string, fn ActionFunc) error {
+	if _, ok := p.byName[rule]; !ok {
+		return fmt.Errorf("rule not found: %s", rule)
+	}
+
+	if fn == nil {
+		delete(p.actions, rule)
+		return nil
+	}
+
+	if p.actions == nil {
+		p.actions = map[string]ActionFunc{}
+	}
+	p.actions[rule] = fn
+	return nil
+}
+
+// Evaluate parses s, runs the actions bottom-up on the resulting tree and
+// returns the value of the root
+//
+// The kids of a node are the values of its children: named children
+// have the value computed for their rule, literals and other anonymous
+// leaves are their text and repetitions are flattened into their parent.
+// Rules without an action evaluate to their only kid, to their text
+// when they have no kids and to the whole kids slice otherwise
+//
+// The actions only run once the whole tree was built, each one for
+// a node of it, and they see the complete subtree of that node. With SetRecovery a tree with error nodes
+// isn't evaluated, the ParseErrorList is returned instead
+func (p *Parser) Evaluate(s string) (any, error) {
+	pe := parseEnviroment{
+		parser: p,
+		input:  s,
+	}
+
+	n, err := pe.parse(false)
+	if err != nil {
+		return nil, err
+	}
+	if err := pe.evaluate(n); err != nil {
+		return nil, err
+	}
+	return n.value, nil
+}
+
+// evaluate computes the values of the named nodes of a tree bottom-up
+func (pe *parseEnviroment) evaluate(n *Node) error {
+	if n.hasValue {
+		return nil
+	}
+
+	for _, c := range n.childs {
+		if c.rule != "" || len(c.childs) > 0 {
+			if err := pe.evaluate(c); err != nil {
+				return err
+			}
+		}
+	}
+	if n.rule == "" {
+		//anonymous nodes are flattened into their parent by kidValues
+		return nil
+	}
+
+	kids := kidValues(n, nil)
+
+	if fn, ok := pe.parser.actions[n.rule]; ok {
+		v, err := fn(n, kids)
+		if err != nil {
+			return &ActionError{
+				Err:  err,
+				Rule: n.rule,
+				Pos:  NewLineIndex(pe.input).Position(n.start),
+			}
+		}
+		n.value = v
+	} else {
+		switch len(kids) {
+		case 0:
+			n.value = n.val
+		case 1:
+			n.value = kids[0]
+		default:
+			n.value = kids
+		}
+	}
+
+	n.hasValue = true
+	return nil
+}
+
+func kidValues(n *Node, dst []any) []any {
+	for _, c := range n.childs {
+		switch {
+		case c.rule != "":
+			dst = append(dst, c.value)
+		case len(c.childs) > 0:
+			dst = kidValues(c, dst)
+		default:
+			dst = append(dst, c.val)
+		}
+	}
+	return dst
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("action for rule %s failed at %s: %s", e.Rule, e.Pos, e.Err)
+}
+
+func (e *ActionError) Unwrap() error {
+	return e.Err
+}
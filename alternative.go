@@ -11,6 +11,7 @@ import (
 	"regexp/syntax"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // matcher typers
@@ -27,6 +28,9 @@ var (
 	regReg     = regexp.MustCompile(`^/((\\/|[^/])*)/`)
 
 	regKnot = regexp.MustCompile(`^(§)`)
+	regAnd  = regexp.MustCompile(`^(&)`)
+	regNot  = regexp.MustCompile(`^(!)`)
+	regFold = regexp.MustCompile(`^(i)`)
 
 	regWhat  = regexp.MustCompile(`^(\?)`)
 	regPlus  = regexp.MustCompile(`^(\+)`)
@@ -47,14 +51,46 @@ const (
 	tkRule         tokenKind = 'R'
 	tkRuleRange    tokenKind = '#'
 	tkRuleOperator tokenKind = '§'
+	tkFold         tokenKind = 'i'
+	tkAnd          tokenKind = '&'
+	tkNot          tokenKind = 'N' //'!' is taken by the validation
 	tkWhiteSpace   tokenKind = ' '
 )
 
 type altToken struct {
 	val  string
+	raw  string //as written in the grammar
+	col  int    //in runes, from 0
 	kind tokenKind
 }
 
+// tokenError is a GrammarError pointing at a token,
+// the line and the rule are filled by NewParser
+func tokenError(tk *altToken, code GrammarErrorCode, msg string, err error) *GrammarError {
+	return &GrammarError{
+		Code:    code,
+		Msg:     msg,
+		Column:  tk.col + 1,
+		Snippet: tk.raw,
+		Err:     err,
+	}
+}
+
+// spanSnippet is the text of consecutive tokens,
+// the whitespace between them becomes spaces
+func spanSnippet(tks []altToken) string {
+	var sb strings.Builder
+	for k := range tks {
+		if k > 0 {
+			prev := &tks[k-1]
+			gap := tks[k].col - prev.col - utf8.RuneCountInString(prev.raw)
+			sb.WriteString(strings.Repeat(" ", gap))
+		}
+		sb.WriteString(tks[k].raw)
+	}
+	return sb.String()
+}
+
 func str2alt(s string, allowEmpty bool) (alternative, error) {
 	tks, e := tokenizeAlternative(s)
 	if e != nil {
@@ -69,66 +105,121 @@ func str2alt(s string, allowEmpty bool) (alternative, error) {
 	}
 
 	var itens []item
-	push := func(i item) {
-		itens = append(itens, i)
+	var refs []altToken
+	for len(tks) > 0 {
+		it, skip, err := tksToItem(tks)
+		if err != nil {
+			return alternative{}, err
+		}
+		itens = append(itens, it)
+		refs = append(refs, refTokens(&it, tks[:skip])...)
+		tks = tks[skip:]
 	}
 
-	for i := 0; i < len(tks); i++ {
-		v := &tks[i]
-
-		switch v.kind {
-		case tkEmpty:
-			return alternative{}, fmt.Errorf("unallowed empty found")
-		case tkLiteral:
-			//TODO possible optimization: single char strings -> singleton
+	return alternative{itens: itens, refs: refs}, nil
+}
 
-			push(item{
-				kind: itemLiteral,
-				lit:  v.val,
-			})
-		case tkSingleton:
-			it, skip, err := tksToRange(tks[i:])
-			if err != nil {
-				return alternative{}, fmt.Errorf("error interpreting range: %w", err)
-			}
-			i += skip - 1
-			push(it)
-
-		case tkRegex:
-			unescaped := strings.ReplaceAll(v.val, `\/`, "/")
-			r, e := regexp.Compile(unescaped)
-			if e != nil {
-				return alternative{}, fmt.Errorf("error compiling regex: %w", e)
-			}
-			if !goodRegex(unescaped) {
-				return alternative{}, fmt.Errorf("regexes must be anchored at the begining (^)")
+// refTokens finds the tokens of the rules referenced by an item, not every
+// rule token is a reference, in 'a' . 'z' - l the l is a rune
+func refTokens(it *item, tks []altToken) []altToken {
+	var ret []altToken
+	for _, r := range it.ruleRefs() {
+		for _, v := range tks {
+			if v.kind == tkRule && v.val == r {
+				ret = append(ret, v)
+				break
 			}
+		}
+	}
+	return ret
+}
 
-			push(item{
-				kind: itemComplex,
-				cplx: (*cplxRegex)(r),
-			})
+// tksToItem converts the tokens at the start of tks into a single item,
+// it also returns how many tokens were used
+func tksToItem(tks []altToken) (item, int, error) {
+	v := &tks[0]
 
-		case tkRule:
-			it, skip, err := tksToRule(tks[i:])
-			if err != nil {
-				return alternative{}, fmt.Errorf("error interpreting rule: %w", err)
-			}
-			i += skip - 1
-			push(it)
+	switch v.kind {
+	case tkEmpty:
+		return item{}, 0, tokenError(v, CodeInvalidAlternative, "unallowed empty found", nil)
+	case tkLiteral:
+		//TODO possible optimization: single char strings -> singleton
 
-		default:
-			return alternative{}, fmt.Errorf("unexpected token")
+		it := item{
+			kind: itemLiteral,
+			lit:  v.val,
+		}
+		if len(tks) > 1 && tks[1].kind == tkFold {
+			it.fold = true
+			return it, 2, nil
 		}
+		return it, 1, nil
+	case tkSingleton:
+		it, skip, err := tksToRange(tks)
+		if err != nil {
+			ge := tokenError(v, CodeInvalidRange, "error interpreting range", err)
+			ge.Snippet = spanSnippet(tks[:skip])
+			return item{}, 0, ge
+		}
+		return it, skip, nil
+
+	case tkRegex:
+		unescaped := strings.ReplaceAll(v.val, `\/`, "/")
+		r, e := regexp.Compile(unescaped)
+		if e != nil {
+			return item{}, 0, tokenError(v, CodeInvalidRegex, "error compiling regex", e)
+		}
+		if !goodRegex(unescaped) {
+			return item{}, 0, tokenError(v, CodeInvalidRegex, "regexes must be anchored at the begining (^)", nil)
+		}
+
+		return item{
+			kind: itemComplex,
+			cplx: (*cplxRegex)(r),
+		}, 1, nil
+
+	case tkRule:
+		it, skip, err := tksToRule(tks)
+		if err != nil {
+			return item{}, 0, tokenError(v, CodeInvalidAlternative, "error interpreting rule", err)
+		}
+		return it, skip, nil
+
+	case tkAnd, tkNot:
+		//the validation makes sure something follows the predicate
+		it, skip, err := tksToItem(tks[1:])
+		if err != nil {
+			return item{}, 0, err
+		}
+		return item{
+			kind: itemLookahead,
+			cplx: &lookahead{
+				it:  it,
+				neg: v.kind == tkNot,
+			},
+		}, skip + 1, nil
 	}
 
-	return alternative{itens: itens}, nil
+	return item{}, 0, tokenError(v, CodeInvalidAlternative, "unexpected token", nil)
 }
 
 func tokenizeAlternative(s string) ([]altToken, error) {
 	orig := s
 	var tks []altToken
 
+	//the i of case insensitive things must be glued to them
+	foldable := func() bool {
+		if len(tks) == 0 {
+			return false
+		}
+		k := tks[len(tks)-1].kind
+		return k == tkLiteral || k == tkSingleton
+	}
+
+	column := func() int {
+		return utf8.RuneCountInString(orig[:len(orig)-len(s)])
+	}
+
 	consume := func(regex *regexp.Regexp, tKind tokenKind) bool {
 		val, rest, ok := consumeRegex(s, regex)
 		if !ok {
@@ -138,6 +229,8 @@ func tokenizeAlternative(s string) ([]altToken, error) {
 		tks = append(tks, altToken{
 			kind: tKind,
 			val:  val,
+			raw:  s[:len(s)-len(rest)],
+			col:  column(),
 		})
 		s = rest
 		return true
@@ -156,6 +249,7 @@ func tokenizeAlternative(s string) ([]altToken, error) {
 			consume(regdot, tkDot),
 			consume(regminus, tkMinus),
 			consume(regReg, tkRegex),
+			foldable() && consume(regFold, tkFold),
 			consume(ruleName, tkRule),
 
 			consume(regWhat, tkRuleRange),
@@ -163,11 +257,22 @@ func tokenizeAlternative(s string) ([]altToken, error) {
 			consume(regPlus, tkRuleRange),
 			consume(regStar, tkRuleRange),
 
-			consume(regKnot, tkRuleOperator):
+			consume(regKnot, tkRuleOperator),
+
+			consume(regAnd, tkAnd),
+			consume(regNot, tkNot):
 
 		default:
-			col := len(orig) - len(s)
-			return nil, fmt.Errorf("couldn't tokenize alternatives at column %d", col)
+			bad := s
+			if i := strings.IndexAny(bad, " \t"); i > 0 {
+				bad = bad[:i]
+			}
+			return nil, &GrammarError{
+				Code:    CodeInvalidAlternative,
+				Msg:     "couldn't tokenize alternative",
+				Column:  column() + 1,
+				Snippet: bad,
+			}
 		}
 
 		if isEmptyOrComment(s) {
@@ -175,7 +280,10 @@ func tokenizeAlternative(s string) ([]altToken, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("alternative too big (max: %d tokens)", maxTokens)
+	return nil, &GrammarError{
+		Code: CodeInvalidAlternative,
+		Msg:  fmt.Sprintf("alternative too big (max: %d tokens)", maxTokens),
+	}
 }
 
 func (tk *altToken) convertRune() rune {
@@ -200,10 +308,18 @@ func tksToRange(tks []altToken) (item, int, error) {
 		ret.kind = itemSimpleRuneRange
 		r := tks[0].convertRune()
 		ret.runes = runeRange{r, r}
+		if len(tks) > 1 && tks[1].kind == tkFold {
+			ret.fold = true
+			return ret, 2, nil
+		}
 		return ret, 1, nil
 	}
 	if !isRange(tks) {
-		return item{}, 99999, fmt.Errorf("invalid syntax")
+		bad := len(tks)
+		if bad > 3 {
+			bad = 3
+		}
+		return item{}, bad, fmt.Errorf("invalid syntax")
 	}
 
 	ol := len(tks)
@@ -213,7 +329,7 @@ func tksToRange(tks []altToken) (item, int, error) {
 	}
 
 	if !base.valid() {
-		return item{}, 99999, fmt.Errorf("invalid range")
+		return item{}, 3, fmt.Errorf("invalid range")
 	}
 
 	consume := func(i int) {
@@ -222,6 +338,11 @@ func tksToRange(tks []altToken) (item, int, error) {
 
 	consume(3) //the original range
 
+	fold := len(tks) > 0 && tks[0].kind == tkFold
+	if fold {
+		consume(1)
+	}
+
 	var excludes []runeRange
 	var inception func() error
 
@@ -248,21 +369,28 @@ func tksToRange(tks []altToken) (item, int, error) {
 	}
 
 	if err := inception(); err != nil {
-		return item{}, 99999, err
+		//up to the token that broke it
+		bad := ol - len(tks)
+		if len(tks) > 0 {
+			bad++
+		}
+		return item{}, bad, err
 	}
 
 	i := item{
 		kind:  itemSimpleRuneRange,
 		runes: base,
+		fold:  fold,
 	}
 	if len(excludes) != 0 {
 		cplx := newComplexRange(base, excludes)
 		if cplx == nil {
-			return item{}, 0, fmt.Errorf("invalid exclusion range")
+			return item{}, ol - len(tks), fmt.Errorf("invalid exclusion range")
 		}
 		i = item{
 			kind: itemComplexRange,
 			cplx: cplx,
+			fold: fold,
 		}
 	}
 
@@ -293,6 +421,52 @@ func (a *alternative) isEmpty() bool {
 	return len(a.itens) == 1 && a.itens[0].kind == itemEmpty
 }
 
+// ruleRefs returns the rules referenced by an item, including
+// the ones inside repetitions and separated lists
+func (it *item) ruleRefs() []string {
+	switch it.kind {
+	case itemRule:
+		return []string{it.lit}
+	case itemComplex:
+		switch c := it.cplx.(type) {
+		case *ruleRange:
+			return []string{c.rule}
+		case *ruleKnot:
+			return append([]string{c.rule}, c.sep.ruleRefs()...)
+		}
+	case itemLookahead:
+		return it.cplx.(*lookahead).it.ruleRefs()
+	}
+	return nil
+}
+
+// String writes the terminals the way error messages show them,
+// it is close to the grammar but ranges use ..
+func (it *item) String() string {
+	var s string
+	switch it.kind {
+	case itemLiteral:
+		s = strconv.Quote(it.lit)
+	case itemSimpleRuneRange:
+		s = it.runes.String()
+	case itemComplexRange:
+		c := it.cplx.(*complexRange)
+		s = c.base.String()
+		for _, v := range c.excludes {
+			s += " - " + v.String()
+		}
+	case itemRule:
+		return it.lit
+	default:
+		return "?"
+	}
+
+	if it.fold {
+		s += "i"
+	}
+	return s
+}
+
 func goodRegex(s string) bool {
 	//this only runs after the compilation, so we don't have to check errors
 	rg, _ := syntax.Parse(s, syntax.Perl)
@@ -312,12 +486,31 @@ func validateAndFilterAltTokens(tks []altToken) ([]altToken, error) {
 		rr = append(rr, rune(v.kind))
 	}
 	synt := string(rr) + " "
+
+	//predicates are glued to the thing they look at, once
+	//that is checked they can be ignored, "&R#" is just "R#"
+	for i, v := range tks {
+		if v.kind != tkAnd && v.kind != tkNot {
+			continue
+		}
+		var next tokenKind
+		if i+1 < len(tks) {
+			next = tks[i+1].kind
+		}
+		switch next {
+		case tkRule, tkLiteral, tkSingleton, tkRegex:
+		default:
+			return nil, tokenError(&tks[i], CodeInvalidAlternative, "misuse of a lookahead predicate", nil)
+		}
+	}
+	synt = strings.NewReplacer("&", "", "N", "").Replace(synt)
 	syntf := synt
 
 	good := []string{
 		"L", "r",
 		"R§R", "R§S",
 		"R#", "R",
+		"S . Si", "S.Si", "Si", "Li", //case insensitive
 		"S . S", "S.S", "S",
 		"-",
 		"E", //this could be a special case, only one empty is allowed
@@ -334,11 +527,17 @@ func validateAndFilterAltTokens(tks []altToken) ([]altToken, error) {
 	}
 
 	if strings.ContainsRune(syntf, '§') {
-		return nil, fmt.Errorf("misuse of the § operator")
+		return nil, &GrammarError{
+			Code: CodeInvalidAlternative,
+			Msg:  "misuse of the § operator",
+		}
 	}
 
 	if strings.Trim(syntf, "! ") != "" {
-		return nil, fmt.Errorf("unrecognized alternative")
+		return nil, &GrammarError{
+			Code: CodeInvalidAlternative,
+			Msg:  "unrecognized alternative",
+		}
 	}
 
 	var ret []altToken
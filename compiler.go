@@ -6,31 +6,78 @@
 package mkf
 
 import (
-	"fmt"
+	"errors"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
-	ruleName = regexp.MustCompile(`^([a-zA-Z_]+)`)
-	ident    = regexp.MustCompile(`^( {4}|\t)`)
+	ruleName   = regexp.MustCompile(`^([a-zA-Z_]+)`)
+	ident      = regexp.MustCompile(`^( {4}|\t)`)
+	annotation = regexp.MustCompile(`^[\t ]+@([a-z-]+)`)
 )
 
 // NewParser returns a new parser... or maybe not
 // it accepts a grammar in a modified McKeeman Form
+//
+// a rule name may be followed by an annotation choosing how the rule
+// picks between its alternatives: @longest, @first or @longest-first-tie
+//
+// literals and rune ranges followed by an i ignore the case,
+// like "select"i or 'a' . 'f'i
 func NewParser(grammar string) (*Parser, error) {
+	p, errs := compile(grammar, false)
+	if len(errs) != 0 {
+		return nil, errs[0]
+	}
+	return p, nil
+}
+
+// NewParserAllErrors is NewParser, but it doesn't stop at the first
+// problem, the error is an ErrorList with all of them sorted by line
+func NewParserAllErrors(grammar string) (*Parser, error) {
+	p, errs := compile(grammar, true)
+	if len(errs) != 0 {
+		errs.Sort()
+		return nil, errs
+	}
+	return p, nil
+}
+
+// compile does the work of NewParser, with all it goes on after
+// the errors, skipping whatever is wrong
+func compile(grammar string, all bool) (*Parser, ErrorList) {
 	lines := strings.Split(grammar, "\n")
 
-	used := map[string]bool{}
+	var errs ErrorList
+	//fail records an error and tells if we must stop
+	fail := func(e *GrammarError) bool {
+		errs = append(errs, e)
+		return !all
+	}
+
+	type ruleRef struct {
+		tk   altToken
+		line int
+		rule string
+	}
+	var refs []ruleRef
 
 	mrules := map[string]bool{}
 	var curr rule //current rule
+	dup := false  //curr is a duplicate, it is checked and thrown away
+	seen := false //curr had an alternative, even one that failed
 
 	var rules []rule
 
 	push := func() {
-		rules = append(rules, curr)
+		if !dup {
+			rules = append(rules, curr)
+		}
 		curr = rule{}
+		dup = false
+		seen = false
 	}
 
 	for k, v := range lines {
@@ -40,31 +87,77 @@ func NewParser(grammar string) (*Parser, error) {
 		}
 
 		if n, rest, ok := consumeRegex(v, ruleName); ok {
-			if !isEmptyOrComment(rest) {
-				return nil, newParseError("unexpected content after rule name", k)
+			var choice Choice
+			if a, r, ok := consumeRegex(rest, annotation); ok {
+				choice = parseChoice(a)
+				if choice == ChoiceDefault {
+					off := len(v) - len(rest) + strings.IndexByte(rest, '@')
+					if fail(newGrammarError(CodeUnknownAnnotation, "unknown rule annotation", v, k, off, "@"+a)) {
+						return nil, errs
+					}
+				}
+				rest = r
 			}
 
-			if mrules[n] {
-				return nil, newParseError("duplicate rule", k)
+			if !isEmptyOrComment(rest) {
+				trimmed := strings.TrimLeft(rest, " \t")
+				off := len(v) - len(trimmed)
+				if fail(newGrammarError(CodeContentAfterRule, "unexpected content after rule name", v, k, off, strings.TrimSpace(trimmed))) {
+					return nil, errs
+				}
 			}
+
 			if curr.name != "" {
 				push()
 			}
+			if mrules[n] {
+				err := newGrammarError(CodeDuplicateRule, "duplicate rule", v, k, 0, n)
+				err.Rule = n
+				if fail(err) {
+					return nil, errs
+				}
+				dup = true
+			}
 			mrules[n] = true
 			curr.name = n
+			curr.choice = choice
+			curr.line = k + 1
 			continue
 		}
 
 		if _, _, ok := consumeRegex(v, ident); ok {
+			trimmed := strings.TrimSpace(v)
+			off := strings.Index(v, trimmed)
 			if curr.name == "" {
-				return nil, newParseError("orphaned alternative", k)
+				if fail(newGrammarError(CodeOrphanedAlternative, "orphaned alternative", v, k, off, trimmed)) {
+					return nil, errs
+				}
+				continue
 			}
-			allowEmpty := len(curr.alternatives) == 0
+			allowEmpty := !seen
+			seen = true
 
 			alt, err := str2alt(v, allowEmpty)
 			if err != nil {
-				//TODO improve this
-				return nil, fmt.Errorf("error parsing alternative at line %d: %w", k, err)
+				var ge *GrammarError
+				if !errors.As(err, &ge) {
+					ge = &GrammarError{
+						Code: CodeInvalidAlternative,
+						Msg:  "invalid alternative",
+						Err:  err,
+					}
+				}
+				ge.Line = k + 1
+				ge.Rule = curr.name
+				if ge.Column == 0 {
+					//it is about the whole alternative
+					ge.Column = utf8.RuneCountInString(v[:off]) + 1
+					ge.Snippet = trimmed
+				}
+				if fail(ge) {
+					return nil, errs
+				}
+				continue
 			}
 
 			if allowEmpty && alt.isEmpty() {
@@ -72,28 +165,41 @@ func NewParser(grammar string) (*Parser, error) {
 				continue
 			}
 
-			for _, item := range alt.itens {
-				if item.kind == itemRule {
-					used[item.lit] = true
-				}
+			for _, tk := range alt.refs {
+				refs = append(refs, ruleRef{tk, k + 1, curr.name})
 			}
 
 			curr.alternatives = append(curr.alternatives, alt)
 			continue
 		}
-		return nil, newParseError("unable to parse grammar", k)
+		if fail(newGrammarError(CodeUnparsableLine, "unable to parse grammar", v, k, 0, strings.TrimRight(v, " \t\r"))) {
+			return nil, errs
+		}
 	}
 
 	//TODO check if rules with  allow empty have other alternatives
-	//TODO check infinite loops
 
 	push()
 
-	for k := range used {
-		if _, ok := mrules[k]; !ok {
-			return nil, fmt.Errorf("rule not found: %s", k)
+	for _, v := range refs {
+		if _, ok := mrules[v.tk.val]; !ok {
+			err := &GrammarError{
+				Code:    CodeRuleNotFound,
+				Msg:     "rule not found: " + v.tk.val,
+				Line:    v.line,
+				Column:  v.tk.col + 1,
+				Rule:    v.rule,
+				Snippet: v.tk.raw,
+			}
+			if fail(err) {
+				return nil, errs
+			}
 		}
 	}
+	if len(errs) != 0 {
+		//the analysis needs every rule to exist
+		return nil, errs
+	}
 
 	rbn := map[string]*rule{} //rules by name
 	for k := range rules {
@@ -101,14 +207,108 @@ func NewParser(grammar string) (*Parser, error) {
 		rbn[v.name] = v
 	}
 
+	if errs := analyzeLeftRecursion(rules, rbn); len(errs) != 0 {
+		return nil, errs
+	}
+
 	//TODO warn unused?
 
 	return &Parser{
-		rules:  rules,
-		byName: rbn,
+		rules:    rules,
+		byName:   rbn,
+		maxDepth: DefaultMaxDepth,
 	}, nil
 }
 
+// SetMemoization turns packrat parsing on or off, when on the result of
+// each rule at each position is remembered, so nothing is parsed twice,
+// at the cost of keeping every intermediate result around until the end
+// of the parse
+func (p *Parser) SetMemoization(on bool) {
+	p.memoize = on
+}
+
+// SetMaxDepth limits how deeply rules may nest while parsing, going
+// deeper fails with a *DepthError, 0 means no limit
+//
+// Without a limit a deeply nested input can exhaust the stack
+// and crash the process
+func (p *Parser) SetMaxDepth(max int) {
+	p.maxDepth = max
+}
+
+// SetUTF8Mode sets how invalid UTF-8 in the input is handled,
+// the default is UTF8Replace
+func (p *Parser) SetUTF8Mode(m UTF8Mode) {
+	p.utf8Mode = m
+}
+
+// SetChoice sets how the rules without an annotation pick between
+// alternatives that match, the default is ChoiceLongest
+func (p *Parser) SetChoice(c Choice) {
+	p.choice = c
+}
+
+// Rules describes every rule of the grammar, in the order they were written
+func (p *Parser) Rules() []RuleInfo {
+	ret := make([]RuleInfo, 0, len(p.rules))
+	for k := range p.rules {
+		ret = append(ret, p.ruleInfo(&p.rules[k]))
+	}
+	return ret
+}
+
+// Rule describes the rule with the given name
+func (p *Parser) Rule(name string) (RuleInfo, bool) {
+	r, ok := p.byName[name]
+	if !ok {
+		return RuleInfo{}, false
+	}
+	return p.ruleInfo(r), true
+}
+
+func (p *Parser) ruleInfo(r *rule) RuleInfo {
+	return RuleInfo{
+		Name:          r.name,
+		Alternatives:  len(r.alternatives),
+		AllowEmpty:    r.allowEmpty,
+		LeftRecursive: r.leftRec,
+		Choice:        p.ruleChoice(r),
+	}
+}
+
+// ruleChoice is the choice policy actually used by a rule
+func (p *Parser) ruleChoice(r *rule) Choice {
+	if r.choice != ChoiceDefault {
+		return r.choice
+	}
+	if p.choice != ChoiceDefault {
+		return p.choice
+	}
+	return ChoiceLongest
+}
+
+func parseChoice(s string) Choice {
+	for c := ChoiceLongest; c <= ChoiceLongestFirstTie; c++ {
+		if c.String() == s {
+			return c
+		}
+	}
+	return ChoiceDefault
+}
+
+func (c Choice) String() string {
+	switch c {
+	case ChoiceLongest:
+		return "longest"
+	case ChoiceFirst:
+		return "first"
+	case ChoiceLongestFirstTie:
+		return "longest-first-tie"
+	}
+	return "default"
+}
+
 func isEmptyOrComment(s string) bool {
 	s = strings.TrimSpace(s)
 	if s == "" {
@@ -130,13 +330,14 @@ func consumeRegex(s string, re *regexp.Regexp) (groupMatch, rest string, ok bool
 	return
 }
 
-func newParseError(err string, line int) *grammarParseError {
-	return &grammarParseError{
-		line: line,
-		err:  err,
+// newGrammarError describes a problem on the k-th line of the grammar,
+// off is where the snippet starts in the line, in bytes
+func newGrammarError(code GrammarErrorCode, msg, line string, k, off int, snippet string) *GrammarError {
+	return &GrammarError{
+		Code:    code,
+		Msg:     msg,
+		Line:    k + 1,
+		Column:  utf8.RuneCountInString(line[:off]) + 1,
+		Snippet: snippet,
 	}
 }
-
-func (g *grammarParseError) Error() string {
-	return fmt.Sprintf("%s, on line: %d", g.err, g.line)
-}
@@ -5,7 +5,12 @@
 
 package mkf
 
-import "testing"
+import (
+	"errors"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
 
 func TestBasic(t *testing.T) {
 	p, e := NewParser(`
@@ -60,6 +65,30 @@ func TestS2AKinds(t *testing.T) {
 		itemSimpleRuneRange,
 	)
 
+	doTest(`"select"i 'a'i 'a' . 'f'i 'a' . 'z'i - 'q' i`, false,
+		itemLiteral,
+		itemSimpleRuneRange,
+		itemSimpleRuneRange,
+		itemComplexRange,
+		itemRule,
+	)
+
+	doTest(`&rule !"x"i !'a' . 'z' - 'q' &/^b/ rule+ !rule§','`, false,
+		itemLookahead,
+		itemLookahead,
+		itemLookahead,
+		itemLookahead,
+		itemComplex,
+		itemLookahead,
+	)
+
+	a, _ := str2alt(` "select"i "from" 'a' . 'f'i 'g' . 'z'`, false)
+	for k, v := range []bool{true, false, true, false} {
+		if a.itens[k].fold != v {
+			t.Errorf("Wrong case folding on item %d", k)
+		}
+	}
+
 	doTestError := func(alt string, allowEmpty bool) {
 		_, e := str2alt(alt, allowEmpty)
 		if e == nil {
@@ -68,6 +97,9 @@ func TestS2AKinds(t *testing.T) {
 	}
 
 	doTestError(` "hello" ""`, false) //empty not alone
+	doTestError(` "hello"ix`, false)
+	doTestError(` 'a'i . 'z'`, false)
+	doTestError(` /^a/i`, false)
 }
 
 func TestAltTokenizer(t *testing.T) {
@@ -106,6 +138,131 @@ test
 	if e == nil {
 		t.Fatal("False positive")
 	}
+
+	_, e = NewParser(`
+test
+    anotherRule+
+`)
+	if e == nil {
+		t.Fatal("False positive inside a repetition")
+	}
+
+	_, e = NewParser(`
+test
+    test§anotherRule
+`)
+	if e == nil {
+		t.Fatal("False positive inside a separator")
+	}
+}
+
+func TestGrammarError(t *testing.T) {
+	tests := []struct {
+		grammar string
+		want    GrammarError
+	}{
+		{"a\n\tb\n", GrammarError{Code: CodeRuleNotFound, Line: 2, Column: 2, Rule: "a", Snippet: "b"}},
+		{"a\n\t\"x\" a§sep\n", GrammarError{Code: CodeRuleNotFound, Line: 2, Column: 8, Rule: "a", Snippet: "sep"}},
+		{"a\n\t'§' /^(/\n", GrammarError{Code: CodeInvalidRegex, Line: 2, Column: 6, Rule: "a", Snippet: "/^(/"}},
+		{"a\n\t/x/\n", GrammarError{Code: CodeInvalidRegex, Line: 2, Column: 2, Rule: "a", Snippet: "/x/"}},
+		{"a\n\t'z' . 'a'\n", GrammarError{Code: CodeInvalidRange, Line: 2, Column: 2, Rule: "a", Snippet: "'z' . 'a'"}},
+		{"a\n\t\"x\" 'z'.'a'i\n", GrammarError{Code: CodeInvalidRange, Line: 2, Column: 6, Rule: "a", Snippet: "'z'.'a'"}},
+		{"a\n\t\"x\" ¬\n", GrammarError{Code: CodeInvalidAlternative, Line: 2, Column: 6, Rule: "a", Snippet: "¬"}},
+		{"a\n\t\"x\" § a\n", GrammarError{Code: CodeInvalidAlternative, Line: 2, Column: 2, Rule: "a", Snippet: `"x" § a`}},
+		{"a\n\t\"x\"\n\na\n\t\"y\"\n", GrammarError{Code: CodeDuplicateRule, Line: 4, Column: 1, Rule: "a", Snippet: "a"}},
+		{"\n\t\"x\"\n", GrammarError{Code: CodeOrphanedAlternative, Line: 2, Column: 2, Snippet: `"x"`}},
+		{"a @shortest\n\t\"x\"\n", GrammarError{Code: CodeUnknownAnnotation, Line: 1, Column: 3, Snippet: "@shortest"}},
+		{"a b\n\t\"x\"\n", GrammarError{Code: CodeContentAfterRule, Line: 1, Column: 3, Snippet: "b"}},
+		{"a\n  \"x\"\n", GrammarError{Code: CodeUnparsableLine, Line: 2, Column: 1, Snippet: `  "x"`}},
+		{"a\n\tb\n\nb\n\ta\n", GrammarError{Code: CodeLeftRecursion, Line: 1, Column: 1, Rule: "a", Snippet: "a"}},
+	}
+
+	for _, v := range tests {
+		_, e := NewParser(v.grammar)
+		var ge *GrammarError
+		if !errors.As(e, &ge) {
+			t.Errorf("Expected a GrammarError for %q, got: %v", v.grammar, e)
+			continue
+		}
+		got := *ge
+		got.Msg, got.Err = "", nil
+		if got != v.want {
+			t.Errorf("Wrong error for %q\nexpected: %+v\ngot:      %+v", v.grammar, v.want, got)
+		}
+	}
+
+	_, e := NewParser("a\n\t/^(/\n")
+	var re *syntax.Error
+	if !errors.As(e, &re) || !strings.Contains(e.Error(), "at 2:2") {
+		t.Errorf("The regexp error should be wrapped: %v", e)
+	}
+}
+
+func TestAllErrors(t *testing.T) {
+	grammar := `
+	"orphan"
+list @shortest
+	'[' item§',' ']'
+	/x/
+
+item
+	value
+	'z' . 'a'
+
+item
+	"again" missing
+
+broken
+	/y/
+	""
+`
+	_, e := NewParserAllErrors(grammar)
+	var l ErrorList
+	if !errors.As(e, &l) {
+		t.Fatalf("Expected an ErrorList, got: %v", e)
+	}
+
+	want := []struct {
+		code GrammarErrorCode
+		line int
+	}{
+		{CodeOrphanedAlternative, 2},
+		{CodeUnknownAnnotation, 3},
+		{CodeInvalidRegex, 5},
+		{CodeRuleNotFound, 8},
+		{CodeInvalidRange, 9},
+		{CodeDuplicateRule, 11},
+		{CodeRuleNotFound, 12},
+		{CodeInvalidRegex, 15},
+		{CodeInvalidAlternative, 16},
+	}
+	if len(l) != len(want) {
+		t.Fatalf("Wrong number of errors, expected: %d, got: %d\n%v", len(want), len(l), l.Unwrap())
+	}
+	for k, v := range want {
+		if l[k].Code != v.code || l[k].Line != v.line {
+			t.Errorf("Wrong error %d, expected: %s on line %d, got: %s", k, v.code, v.line, l[k])
+		}
+	}
+	if !strings.HasSuffix(e.Error(), "(and 8 more errors)") {
+		t.Errorf("Wrong message: %s", e)
+	}
+
+	var ge *GrammarError
+	if !errors.As(e, &ge) || ge.Code != CodeOrphanedAlternative {
+		t.Errorf("errors.As should find the first GrammarError: %v", ge)
+	}
+
+	//the left recursion is only analyzed when nothing else is wrong
+	_, e = NewParserAllErrors("a\n\tb\n\nb\n\ta\n\nc\n\td\n\nd\n\tc\n")
+	if !errors.As(e, &l) || len(l) != 2 || l[1].Rule != "c" {
+		t.Errorf("Expected both left recursion errors: %v", e)
+	}
+
+	p, e := NewParserAllErrors(testArrayParser)
+	if p == nil || e != nil {
+		t.Errorf("Should have worked: %v", e)
+	}
 }
 
 func BenchmarkCompilation(b *testing.B) {
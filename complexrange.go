@@ -5,6 +5,8 @@
 
 package mkf
 
+import "strconv"
+
 func newComplexRange(base runeRange, excludes []runeRange) *complexRange {
 	if !base.valid() {
 		return nil
@@ -42,6 +44,13 @@ func (r runeRange) inRange(char rune) bool {
 	return r[0] <= char && char <= r[1]
 }
 
+func (r runeRange) String() string {
+	if r[0] == r[1] {
+		return strconv.QuoteRune(r[0])
+	}
+	return strconv.QuoteRune(r[0]) + ".." + strconv.QuoteRune(r[1])
+}
+
 // match only exists to implement the matcher interface
 func (c *complexRange) match(*parseEnviroment, string) (*Node, bool) {
 	panic("shouldn't be here")
@@ -0,0 +1,137 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+// WriteDOT writes the tree rooted at n as a Graphviz digraph,
+// named nodes are labeled with their rule and leaves with their text,
+// the error nodes made by the recovery are red and start with "!"
+func WriteDOT(w io.Writer, n *Node) error {
+	tw := treeWriter{w: w}
+	tw.print("digraph parseTree {\n\tnode [shape=box];\n")
+
+	var ids []int
+	next := 0
+
+	Walk(n, &visitorFuncs{
+		enter: func(n *Node) (bool, error) {
+			id := next
+			next++
+
+			label := n.rule
+			attrs := ""
+			switch {
+			case n.rule != "":
+			case len(n.childs) == 0:
+				label = strconv.Quote(n.val)
+				attrs = ", shape=plaintext"
+			default:
+				label = "_"
+				attrs = ", shape=ellipse"
+			}
+			if n.err != nil {
+				label = errorMark(n) + label
+				attrs += ", color=red"
+			}
+
+			tw.print(fmt.Sprintf("\tn%d [label=%s%s];\n", id, dotQuote(label), attrs))
+			if len(ids) > 0 {
+				tw.print(fmt.Sprintf("\tn%d -> n%d;\n", ids[len(ids)-1], id))
+			}
+
+			ids = append(ids, id)
+			return false, tw.err
+		},
+		exit: func(*Node) error {
+			ids = ids[:len(ids)-1]
+			return nil
+		},
+	})
+
+	tw.print("}\n")
+	return tw.err
+}
+
+// WriteRuleGraphDOT writes which rules reference which as a Graphviz
+// digraph, references made by repetitions are labeled with their
+// quantifier and the ones made by separated lists with § (or "sep")
+func (p *Parser) WriteRuleGraphDOT(w io.Writer) error {
+	tw := treeWriter{w: w}
+	tw.print("digraph grammar {\n\tnode [shape=box];\n")
+
+	for k := range p.rules {
+		r := &p.rules[k]
+		attrs := ""
+		if k == p.root {
+			attrs = ", peripheries=2"
+		}
+		tw.print(fmt.Sprintf("\t%s [label=%s%s];\n", dotQuote(r.name), dotQuote(r.name), attrs))
+	}
+
+	type edge struct {
+		from, to, label string
+	}
+	seen := map[edge]bool{}
+
+	for k := range p.rules {
+		r := &p.rules[k]
+		for _, alt := range r.alternatives {
+			for _, it := range alt.itens {
+				var edges []edge
+				switch it.kind {
+				case itemRule:
+					edges = []edge{{r.name, it.lit, ""}}
+				case itemComplex:
+					switch c := it.cplx.(type) {
+					case *ruleRange:
+						edges = []edge{{r.name, c.rule, c.String()}}
+					case *ruleKnot:
+						edges = []edge{{r.name, c.rule, "§"}}
+						for _, s := range c.sep.ruleRefs() {
+							edges = append(edges, edge{r.name, s, "sep"})
+						}
+					}
+				case itemLookahead:
+					label := "&"
+					if it.cplx.(*lookahead).neg {
+						label = "!"
+					}
+					for _, s := range it.ruleRefs() {
+						edges = append(edges, edge{r.name, s, label})
+					}
+				}
+
+				for _, e := range edges {
+					if seen[e] {
+						continue
+					}
+					seen[e] = true
+
+					tw.print(fmt.Sprintf("\t%s -> %s", dotQuote(e.from), dotQuote(e.to)))
+					if e.label != "" {
+						tw.print(fmt.Sprintf(" [label=%s]", dotQuote(e.label)))
+					}
+					tw.print(";\n")
+				}
+			}
+		}
+	}
+
+	tw.print("}\n")
+	return tw.err
+}
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
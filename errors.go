@@ -0,0 +1,247 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The codes of the grammar errors
+const (
+	CodeUnparsableLine      GrammarErrorCode = "unparsable-line"
+	CodeUnknownAnnotation   GrammarErrorCode = "unknown-annotation"
+	CodeContentAfterRule    GrammarErrorCode = "content-after-rule"
+	CodeDuplicateRule       GrammarErrorCode = "duplicate-rule"
+	CodeOrphanedAlternative GrammarErrorCode = "orphaned-alternative"
+	CodeInvalidAlternative  GrammarErrorCode = "invalid-alternative"
+	CodeInvalidRange        GrammarErrorCode = "invalid-range"
+	CodeInvalidRegex        GrammarErrorCode = "invalid-regex"
+	CodeRuleNotFound        GrammarErrorCode = "rule-not-found"
+	CodeLeftRecursion       GrammarErrorCode = "left-recursion"
+)
+
+func (e *GrammarError) Error() string {
+	msg := e.Msg
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	switch {
+	case e.Line == 0:
+		return msg
+	case e.Column == 0:
+		return fmt.Sprintf("%s on line %d", msg, e.Line)
+	}
+	return fmt.Sprintf("%s at %d:%d", msg, e.Line, e.Column)
+}
+
+func (e *GrammarError) Unwrap() error {
+	return e.Err
+}
+
+func (l ErrorList) Error() string {
+	return listError(l)
+}
+
+// Unwrap lets errors.Is and errors.As look at every error of the list
+func (l ErrorList) Unwrap() []error {
+	return unwrapList(l)
+}
+
+// Sort sorts the list by line and column
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].Line != l[j].Line {
+			return l[i].Line < l[j].Line
+		}
+		return l[i].Column < l[j].Column
+	})
+}
+
+func (l ParseErrorList) Error() string {
+	return listError(l)
+}
+
+// Unwrap lets errors.Is and errors.As look at every error of the list
+func (l ParseErrorList) Unwrap() []error {
+	return unwrapList(l)
+}
+
+// listError is the message of a list of errors, the first one
+// and how many follow it
+func listError[E error](l []E) string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+func unwrapList[E error](l []E) []error {
+	ret := make([]error, len(l))
+	for k, v := range l {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (e *ParseError) Error() string {
+	found := "end of input"
+	if e.Found != "" {
+		found = strconv.Quote(e.Found)
+		if r := []rune(e.Found); len(r) == 1 {
+			found = strconv.QuoteRune(r[0])
+		}
+	}
+
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("unexpected trailing input at %s, found %s", e.Pos, found)
+	}
+
+	return fmt.Sprintf("expected %s at %s, found %s", orList(e.Expected), e.Pos, found)
+}
+
+// orList joins a list like "a, b or c"
+func orList(l []string) string {
+	if len(l) == 1 {
+		return l[0]
+	}
+	return strings.Join(l[:len(l)-1], ", ") + " or " + l[len(l)-1]
+}
+
+const (
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[1;31m"
+	ansiReset = "\x1b[0m"
+)
+
+// FormatError writes err like a compiler would: the message, the line of
+// source where it happened and a ^~~~ marker under the offending part,
+// source is the grammar for grammar errors and the input for the others
+//
+// Lists write each of their errors, errors without a position
+// only write the message
+func FormatError(err error, source string) string {
+	return FormatErrorWith(err, source, ErrorFormatOptions{})
+}
+
+// FormatErrorWith is FormatError with options
+func FormatErrorWith(err error, source string, opts ErrorFormatOptions) string {
+	if err == nil {
+		return ""
+	}
+
+	li := NewLineIndex(source)
+	var sb strings.Builder
+	for _, v := range errorSpans(err) {
+		writeErrorSpan(&sb, li, v, opts)
+	}
+	return sb.String()
+}
+
+// errorSpans finds where err points, the lists are split
+func errorSpans(err error) []errorSpan {
+	var gl ErrorList
+	var pl ParseErrorList
+	var ge *GrammarError
+	var pe *ParseError
+	var de *DepthError
+	var ae *ActionError
+	var ee *EncodingError
+
+	pos := func(p Position) errorSpan {
+		return errorSpan{err.Error(), p.Line, p.Column, 1}
+	}
+
+	switch {
+	case errors.As(err, &gl):
+		var ret []errorSpan
+		for _, v := range gl {
+			ret = append(ret, errorSpans(v)...)
+		}
+		return ret
+	case errors.As(err, &pl):
+		var ret []errorSpan
+		for _, v := range pl {
+			ret = append(ret, errorSpans(v)...)
+		}
+		return ret
+
+	case errors.As(err, &ge):
+		width := utf8.RuneCountInString(ge.Snippet)
+		if width == 0 {
+			width = 1
+		}
+		return []errorSpan{{err.Error(), ge.Line, ge.Column, width}}
+	case errors.As(err, &pe):
+		return []errorSpan{pos(pe.Pos)}
+	case errors.As(err, &de):
+		return []errorSpan{pos(de.Pos)}
+	case errors.As(err, &ae):
+		return []errorSpan{pos(ae.Pos)}
+	case errors.As(err, &ee):
+		return []errorSpan{pos(ee.Pos)}
+	}
+
+	return []errorSpan{{msg: err.Error()}}
+}
+
+func writeErrorSpan(sb *strings.Builder, li *LineIndex, sp errorSpan, opts ErrorFormatOptions) {
+	paint := func(color, s string) string {
+		if !opts.Color {
+			return s
+		}
+		return color + s + ansiReset
+	}
+
+	sb.WriteString(paint(ansiBold, sp.msg))
+	sb.WriteByte('\n')
+	if sp.line < 1 || sp.line > li.Lines() || sp.col < 1 {
+		return
+	}
+
+	//the marker copies the whitespace of the line, so it stays aligned
+	var text, pad, mark strings.Builder
+	visual := 0
+	for i, r := range []rune(li.Line(sp.line)) {
+		s, blank := string(r), " "
+		if r == '\t' {
+			blank = "\t"
+			if opts.TabWidth > 0 {
+				n := opts.TabWidth - visual%opts.TabWidth
+				s = strings.Repeat(" ", n)
+				blank = s
+			}
+		}
+		visual += utf8.RuneCountInString(s)
+		text.WriteString(s)
+
+		switch {
+		case i < sp.col-1:
+			pad.WriteString(blank)
+		case i < sp.col-1+sp.width:
+			mark.WriteString(strings.Repeat("~", utf8.RuneCountInString(blank)))
+		}
+	}
+	if mark.Len() == 0 {
+		//past the end of the line
+		pad.WriteString(strings.Repeat(" ", sp.col-1-utf8.RuneCountInString(li.Line(sp.line))))
+		mark.WriteString("~")
+	}
+	marker := "^" + mark.String()[1:]
+
+	num := strconv.Itoa(sp.line)
+	gutter := strings.Repeat(" ", len(num))
+	fmt.Fprintf(sb, " %s | %s\n", num, text.String())
+	fmt.Fprintf(sb, " %s | %s%s\n", gutter, pad.String(), paint(ansiRed, marker))
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// foldPrefix checks if s starts with lit ignoring the case, using
+// the Unicode simple case folding, it returns how many bytes of s
+// matched, which may be different from the length of lit (K and K)
+func foldPrefix(s, lit string) (int, bool) {
+	n := 0
+	for _, lr := range lit {
+		sr, l := utf8.DecodeRuneInString(s[n:])
+		if l == 0 || !foldEqual(lr, sr) {
+			return 0, false
+		}
+		n += l
+	}
+	return n, true
+}
+
+func foldEqual(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for r := unicode.SimpleFold(a); r != a; r = unicode.SimpleFold(r) {
+		if r == b {
+			return true
+		}
+	}
+	return false
+}
+
+// foldInRange checks if any rune of the case folding orbit of c is in range
+func foldInRange(c rune, inRange func(rune) bool) bool {
+	for r := unicode.SimpleFold(c); r != c; r = unicode.SimpleFold(r) {
+		if inRange(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,506 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The forest is built by a chart parser: every rule is expanded once at
+// each offset, finding every end it can reach and every way of reaching
+// it, so the alternatives are all kept instead of just the chosen one.
+// Repetitions and separated lists are built from inner nodes too, one per
+// start, end and count, which the trees never show.
+//
+// Left recursion is handled by repeating the expansion of a left recursive
+// rule until nothing new is found, while that happens the results of every
+// rule at that offset are considered incomplete and expanded again when
+// needed.
+
+// ParseForest parses the whole input keeping every derivation,
+// the choice policies don't apply here, every alternative is considered
+//
+// Regexes still match only one way, the same as in ParseString
+func (p *Parser) ParseForest(s string) (*Forest, error) {
+	if len(p.rules) == 0 {
+		return nil, fmt.Errorf("empty grammar")
+	}
+
+	fe := forestEnviroment{
+		pe: &parseEnviroment{
+			parser: p,
+			input:  s,
+		},
+		nodes:   map[forestKey]*forestNode{},
+		rules:   map[memoKey]*forestEntry{},
+		growing: map[int]int{},
+	}
+	if err := fe.pe.checkEncoding(); err != nil {
+		return nil, err
+	}
+
+	root := p.rules[p.root].name
+	longest := -1
+	for _, n := range fe.rule(root, 0) {
+		if n.end == len(s) {
+			return &Forest{
+				root:  n,
+				input: s,
+			}, nil
+		}
+		if n.end > longest {
+			longest = n.end
+		}
+	}
+
+	if fe.pe.err != nil {
+		return nil, fe.pe.err
+	}
+	if fe.pe.fail.pos < longest {
+		fe.pe.fail = failure{pos: longest}
+	}
+	return nil, fe.pe.parseError()
+}
+
+// ParseAll returns every tree the whole input can be parsed into,
+// beware that ambiguous grammars may have exponentially many of them
+func (p *Parser) ParseAll(s string) ([]*Node, error) {
+	f, err := p.ParseForest(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*Node
+	for it := f.Trees(); it.Next(); {
+		ret = append(ret, it.Tree())
+	}
+	return ret, nil
+}
+
+// Trees returns an iterator over every tree of the forest,
+// derivations going around in circles are skipped
+func (f *Forest) Trees() *TreeIterator {
+	return &TreeIterator{
+		forest: f,
+	}
+}
+
+// Ambiguous reports whether some node of the forest can be derived in
+// more than one way, which usually means more than one tree
+func (f *Forest) Ambiguous() bool {
+	seen := map[*forestNode]bool{}
+	stack := []*forestNode{f.root}
+
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+
+		if len(n.packs) > 1 {
+			return true
+		}
+		for _, p := range n.packs {
+			stack = append(stack, p...)
+		}
+	}
+
+	return false
+}
+
+// Next builds the next tree, it returns false when there are no more
+func (it *TreeIterator) Next() bool {
+	for !it.done {
+		if it.started && !it.advance() {
+			break
+		}
+		it.started = true
+
+		it.next = 0
+		t, ok := it.build(it.forest.root, map[*forestNode]bool{})
+		it.choices = it.choices[:it.next]
+
+		if ok {
+			it.tree = t
+			return true
+		}
+	}
+
+	it.done = true
+	it.tree = nil
+	return false
+}
+
+// Tree returns the tree built by the last call to Next
+func (it *TreeIterator) Tree() *Node {
+	return it.tree
+}
+
+// advance works like an odometer, the last choice that still has options
+// is incremented and the ones after it are forgotten, as they may not
+// even exist with the new choice
+func (it *TreeIterator) advance() bool {
+	for len(it.choices) > 0 {
+		c := &it.choices[len(it.choices)-1]
+		if c.n+1 < c.of {
+			c.n++
+			return true
+		}
+		it.choices = it.choices[:len(it.choices)-1]
+	}
+	return false
+}
+
+func (it *TreeIterator) choose(of int) int {
+	if it.next < len(it.choices) {
+		c := it.choices[it.next]
+		it.next++
+		return c.n
+	}
+
+	it.choices = append(it.choices, treeChoice{n: 0, of: of})
+	it.next++
+	return 0
+}
+
+func (it *TreeIterator) build(fn *forestNode, path map[*forestNode]bool) (*Node, bool) {
+	n := &Node{
+		rule:  fn.rule,
+		val:   it.forest.input[fn.start:fn.end],
+		start: fn.start,
+		end:   fn.end,
+	}
+	if fn.leaf {
+		return n, true
+	}
+
+	if path[fn] {
+		//a derivation of this node needs this node
+		return nil, false
+	}
+	path[fn] = true
+	defer delete(path, fn)
+
+	pack := fn.packs[0]
+	if len(fn.packs) > 1 {
+		pack = fn.packs[it.choose(len(fn.packs))]
+	}
+
+	for _, v := range pack {
+		c, ok := it.build(v, path)
+		if !ok {
+			return nil, false
+		}
+		if v.chain != 0 {
+			//inner nodes only exist to be shared
+			n.childs = append(n.childs, c.childs...)
+			continue
+		}
+		n.childs = append(n.childs, c)
+	}
+
+	return n, true
+}
+
+// rule returns the nodes for every way the rule matches at pos,
+// one for each end
+func (fe *forestEnviroment) rule(name string, pos int) []*forestNode {
+	key := memoKey{
+		rule:   name,
+		offset: pos,
+	}
+	e := fe.rules[key]
+	if e == nil {
+		e = &forestEntry{}
+		fe.rules[key] = e
+	}
+	if e.done || e.busy || fe.pe.err != nil {
+		return e.nodes
+	}
+
+	ok := fe.pe.descend(name, fe.pe.input[pos:])
+	defer func() {
+		fe.pe.depth--
+	}()
+	if !ok {
+		return nil
+	}
+
+	r := fe.pe.parser.byName[name]
+	e.busy = true
+
+	if r.leftRec && fe.growing[pos] == 0 {
+		//whoever called us must know if anything changed
+		changed := fe.changed
+
+		fe.growing[pos]++
+		for {
+			fe.changed = false
+			fe.expand(r, pos, e)
+			if !fe.changed || fe.pe.err != nil {
+				break
+			}
+			changed = true
+		}
+		fe.growing[pos]--
+
+		fe.changed = changed
+		e.done = true
+	} else {
+		fe.expand(r, pos, e)
+		e.done = fe.growing[pos] == 0
+	}
+
+	e.busy = false
+	return e.nodes
+}
+
+func (fe *forestEnviroment) expand(r *rule, pos int, e *forestEntry) {
+	add := func(end int, kids []*forestNode) {
+		n := fe.node(forestKey{rule: r.name, start: pos, end: end})
+		fe.addPack(n, kids)
+
+		for _, v := range e.nodes {
+			if v == n {
+				return
+			}
+		}
+		e.nodes = append(e.nodes, n)
+		fe.changed = true
+	}
+
+	if r.allowEmpty {
+		add(pos, nil)
+	}
+
+	for k := range r.alternatives {
+		for _, m := range fe.seq(r.alternatives[k].itens, pos) {
+			add(m.end, m.kids)
+		}
+	}
+}
+
+// seq returns every way a sequence of items matches at pos
+func (fe *forestEnviroment) seq(items []item, pos int) []seqMatch {
+	if len(items) == 0 {
+		return []seqMatch{{end: pos}}
+	}
+	if items[0].kind == itemLookahead {
+		//predicates are matched the usual way and leave no node
+		if _, ok := items[0].cplx.match(fe.pe, fe.pe.input[pos:]); !ok {
+			return nil
+		}
+		return fe.seq(items[1:], pos)
+	}
+
+	var ret []seqMatch
+	for _, first := range fe.item(&items[0], pos) {
+		for _, rest := range fe.seq(items[1:], first.end) {
+			kids := append([]*forestNode{first}, rest.kids...)
+			ret = append(ret, seqMatch{
+				kids: kids,
+				end:  rest.end,
+			})
+		}
+	}
+	return ret
+}
+
+// item returns a node for each end the item can reach from pos
+func (fe *forestEnviroment) item(it *item, pos int) []*forestNode {
+	if fe.pe.err != nil {
+		return nil
+	}
+
+	s := fe.pe.input[pos:]
+
+	switch it.kind {
+	case itemRule:
+		return fe.rule(it.lit, pos)
+
+	case itemComplex:
+		switch c := it.cplx.(type) {
+		case *ruleRange:
+			return fe.repetition(it, c, pos)
+		case *ruleKnot:
+			return fe.knot(it, c, pos)
+		}
+	}
+
+	var n *Node
+	var ok bool
+	if it.kind == itemComplex {
+		n, ok = it.cplx.match(fe.pe, s)
+	} else {
+		n, ok = fe.pe.matchTerminal(it, s)
+	}
+	if !ok {
+		return nil
+	}
+
+	fn := fe.node(forestKey{it: it, start: pos, end: pos + len(n.val)})
+	fn.leaf = true
+	return []*forestNode{fn}
+}
+
+// repetition matches rule{min,max}, the repetitions matching nothing
+// are ignored once the minimum is reached, they would go on forever
+//
+// The matches are chains of inner nodes, each one is the previous one
+// plus a rule and they are shared by every derivation, so the forest
+// stays polynomial however ambiguous the rule is
+func (fe *forestEnviroment) repetition(it *item, r *ruleRange, pos int) []*forestNode {
+	min, max := r.ran[0], r.ran[1]
+
+	//without a maximum the count only matters until the minimum
+	top := min
+	if top < 1 {
+		top = 1
+	}
+	next := func(count int32) int32 {
+		if max == math.MaxInt32 && count >= top {
+			return top
+		}
+		return count + 1
+	}
+
+	var ret []*forestNode
+	if min == 0 {
+		ret = fe.wrap(it, pos, []seqMatch{{end: pos}}, ret)
+	}
+
+	var work []*forestNode
+	seen := map[*forestNode]bool{}
+	extend := func(prev *forestNode, count int32, end int) {
+		if count == max {
+			return
+		}
+		for _, n := range fe.rule(r.rule, end) {
+			if n.end == end && count >= min {
+				continue
+			}
+			kids := []*forestNode{n}
+			if prev != nil {
+				kids = []*forestNode{prev, n}
+			}
+			c := fe.node(forestKey{it: it, start: pos, end: n.end, chain: next(count)})
+			fe.addPack(c, kids)
+			if !seen[c] {
+				seen[c] = true
+				work = append(work, c)
+			}
+		}
+	}
+
+	extend(nil, 0, pos)
+	for len(work) > 0 {
+		c := work[0]
+		work = work[1:]
+		if c.chain >= min {
+			ret = fe.wrap(it, pos, []seqMatch{{kids: []*forestNode{c}, end: c.end}}, ret)
+		}
+		extend(c, c.chain, c.end)
+	}
+
+	return ret
+}
+
+// knot matches rule§sep, like ruleKnot.match a separator is only part
+// of the match if a rule follows it, the matches are chains of inner
+// nodes like the ones of repetition
+func (fe *forestEnviroment) knot(it *item, k *ruleKnot, pos int) []*forestNode {
+	var work []*forestNode
+	seen := map[*forestNode]bool{}
+	push := func(end int, kids []*forestNode) {
+		c := fe.node(forestKey{it: it, start: pos, end: end, chain: 1})
+		fe.addPack(c, kids)
+		if !seen[c] {
+			seen[c] = true
+			work = append(work, c)
+		}
+	}
+
+	for _, n := range fe.rule(k.rule, pos) {
+		push(n.end, []*forestNode{n})
+	}
+
+	var ret []*forestNode
+	for len(work) > 0 {
+		c := work[0]
+		work = work[1:]
+		ret = fe.wrap(it, pos, []seqMatch{{kids: []*forestNode{c}, end: c.end}}, ret)
+
+		for _, sep := range fe.item(&k.sep, c.end) {
+			for _, n := range fe.rule(k.rule, sep.end) {
+				if n.end == c.end {
+					//nothing was consumed, it would never end
+					continue
+				}
+				push(n.end, []*forestNode{c, sep, n})
+			}
+		}
+	}
+
+	return ret
+}
+
+// wrap adds the matches as packs of the anonymous nodes of an item
+func (fe *forestEnviroment) wrap(it *item, pos int, ms []seqMatch, dst []*forestNode) []*forestNode {
+	for _, m := range ms {
+		n := fe.node(forestKey{it: it, start: pos, end: m.end})
+		fe.addPack(n, m.kids)
+
+		found := false
+		for _, v := range dst {
+			found = found || v == n
+		}
+		if !found {
+			dst = append(dst, n)
+		}
+	}
+	return dst
+}
+
+func (fe *forestEnviroment) node(key forestKey) *forestNode {
+	if n, ok := fe.nodes[key]; ok {
+		return n
+	}
+
+	n := &forestNode{
+		rule:  key.rule,
+		start: key.start,
+		end:   key.end,
+		chain: key.chain,
+		id:    len(fe.nodes),
+	}
+	fe.nodes[key] = n
+	fe.changed = true
+	return n
+}
+
+func (fe *forestEnviroment) addPack(n *forestNode, kids []*forestNode) {
+	var sb strings.Builder
+	for _, v := range kids {
+		sb.WriteString(strconv.Itoa(v.id))
+		sb.WriteByte(',')
+	}
+	pk := sb.String()
+
+	if n.packKeys[pk] {
+		return
+	}
+	if n.packKeys == nil {
+		n.packKeys = map[string]bool{}
+	}
+	n.packKeys[pk] = true
+	n.packs = append(n.packs, kids)
+	fe.changed = true
+}
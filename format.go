@@ -0,0 +1,161 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxOutlineText is how many runes of text the outline shows per node
+const maxOutlineText = 40
+
+// FormatTree writes the tree rooted at n to w
+//
+// In the S-expression style named nodes are (rule kids...), anonymous
+// leaves are their quoted text and anonymous wrappers (like the ones from
+// repetitions) are flattened into their parent. The outline shows every
+// node, anonymous wrappers are named "_". In both the error nodes made
+// by the recovery start with "!"
+func FormatTree(w io.Writer, n *Node, style TreeStyle) error {
+	tw := treeWriter{w: w}
+
+	switch style {
+	case StyleSExpr:
+		tw.sexpr(n)
+	case StyleOutline:
+		tw.outline(n)
+	default:
+		return fmt.Errorf("unknown tree style: %d", style)
+	}
+
+	return tw.err
+}
+
+// Format implements fmt.Formatter, %v and %s print the S-expression,
+// %+v the outline and %q the quoted text
+func (n *Node) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'q':
+		io.WriteString(f, strconv.Quote(n.val))
+	case verb == 'v' && f.Flag('+'):
+		FormatTree(f, n, StyleOutline)
+	default:
+		FormatTree(f, n, StyleSExpr)
+	}
+}
+
+func (n *Node) String() string {
+	var sb strings.Builder
+	FormatTree(&sb, n, StyleSExpr)
+	return sb.String()
+}
+
+func (tw *treeWriter) print(s ...string) {
+	for _, v := range s {
+		if tw.err != nil {
+			return
+		}
+		_, tw.err = io.WriteString(tw.w, v)
+	}
+}
+
+func (tw *treeWriter) sexpr(root *Node) {
+	if root == nil {
+		tw.print("()")
+		return
+	}
+
+	first := true
+	sep := func() {
+		if !first {
+			tw.print(" ")
+		}
+		first = false
+	}
+
+	Walk(root, &visitorFuncs{
+		enter: func(n *Node) (bool, error) {
+			switch {
+			case n.rule != "":
+				sep()
+				tw.print(errorMark(n), "(", n.rule)
+				first = false
+				if n.err != nil && len(n.childs) == 0 {
+					//the text is all there is to see
+					tw.print(" ", strconv.Quote(n.val))
+				}
+			case len(n.childs) == 0:
+				sep()
+				tw.print(errorMark(n), strconv.Quote(n.val))
+			}
+			return false, tw.err
+		},
+		exit: func(n *Node) error {
+			if n.rule != "" {
+				tw.print(")")
+			}
+			return tw.err
+		},
+	})
+}
+
+func (tw *treeWriter) outline(root *Node) {
+	if root == nil {
+		return
+	}
+
+	depth := 0
+	Walk(root, &visitorFuncs{
+		enter: func(n *Node) (bool, error) {
+			tw.print(strings.Repeat("  ", depth), errorMark(n))
+
+			switch {
+			case n.rule != "":
+				tw.print(n.rule, " ")
+			case len(n.childs) > 0:
+				tw.print("_ ")
+			}
+
+			tw.print(shortQuote(n.val), " ", strconv.Itoa(n.start), ":", strconv.Itoa(n.end), "\n")
+			depth++
+			return false, tw.err
+		},
+		exit: func(n *Node) error {
+			depth--
+			return nil
+		},
+	})
+}
+
+// errorMark is the prefix of the error nodes
+func errorMark(n *Node) string {
+	if n.err != nil {
+		return "!"
+	}
+	return ""
+}
+
+// shortQuote quotes s, cutting it if it's too long
+func shortQuote(s string) string {
+	if utf8.RuneCountInString(s) <= maxOutlineText {
+		return strconv.Quote(s)
+	}
+
+	r := []rune(s)[:maxOutlineText]
+	return strconv.Quote(string(r)) + "..."
+}
+
+func (v *visitorFuncs) Enter(n *Node) (bool, error) {
+	return v.enter(n)
+}
+
+func (v *visitorFuncs) Exit(n *Node) error {
+	return v.exit(n)
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MarshalJSON encodes the whole tree as
+// {"rule", "text", "start", "end", "children"} objects,
+// the error nodes made by the recovery also have an "error"
+func (n *Node) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.toJSON(JSONOptions{}))
+}
+
+// UnmarshalJSON decodes trees written by MarshalJSON or EncodeJSON,
+// a missing text is rebuilt from the children, which is only exact
+// if the anonymous leaves weren't omitted
+func (n *Node) UnmarshalJSON(data []byte) error {
+	var jn jsonNode
+	if err := json.Unmarshal(data, &jn); err != nil {
+		return err
+	}
+
+	d, err := jn.toNode()
+	if err != nil {
+		return err
+	}
+	*n = *d
+	return nil
+}
+
+// EncodeJSON writes the tree rooted at n to w
+func EncodeJSON(w io.Writer, n *Node, opts JSONOptions) error {
+	return json.NewEncoder(w).Encode(n.toJSON(opts))
+}
+
+// DecodeJSON reads a tree written by EncodeJSON
+func DecodeJSON(r io.Reader) (*Node, error) {
+	var jn jsonNode
+	if err := json.NewDecoder(r).Decode(&jn); err != nil {
+		return nil, err
+	}
+	return jn.toNode()
+}
+
+func (n *Node) toJSON(opts JSONOptions) *jsonNode {
+	jn := &jsonNode{
+		Rule:  n.rule,
+		Start: n.start,
+		End:   n.end,
+	}
+
+	if e := n.err; e != nil {
+		jn.Error = &jsonError{
+			Offset:     e.Pos.Offset,
+			Line:       e.Pos.Line,
+			Column:     e.Pos.Column,
+			ByteColumn: e.Pos.ByteColumn,
+			Expected:   e.Expected,
+			Found:      e.Found,
+			Stack:      e.Stack,
+		}
+	}
+
+	for _, c := range n.childs {
+		if opts.OmitAnonymousLeaves && c.rule == "" && len(c.childs) == 0 && c.err == nil {
+			continue
+		}
+		jn.Children = append(jn.Children, c.toJSON(opts))
+	}
+
+	//inner is decided after the filtering, or the text could be lost
+	if len(jn.Children) == 0 || !opts.OmitInnerText {
+		txt := n.val
+		jn.Text = &txt
+	}
+
+	return jn
+}
+
+func (jn *jsonNode) toNode() (*Node, error) {
+	if jn.End < jn.Start {
+		return nil, fmt.Errorf("invalid node span: %d-%d", jn.Start, jn.End)
+	}
+
+	n := &Node{
+		rule:  jn.Rule,
+		start: jn.Start,
+		end:   jn.End,
+	}
+	if e := jn.Error; e != nil {
+		n.err = &ParseError{
+			Pos: Position{
+				Offset:     e.Offset,
+				Line:       e.Line,
+				Column:     e.Column,
+				ByteColumn: e.ByteColumn,
+			},
+			Expected: e.Expected,
+			Found:    e.Found,
+			Stack:    e.Stack,
+		}
+	}
+
+	var sb strings.Builder
+	for _, v := range jn.Children {
+		c, err := v.toNode()
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(c.val)
+		n.childs = append(n.childs, c)
+	}
+
+	if jn.Text != nil {
+		n.val = *jn.Text
+	} else {
+		n.val = sb.String()
+	}
+
+	return n, nil
+}
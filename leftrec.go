@@ -0,0 +1,375 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Left recursion works by growing a seed: the first time a left recursive
+// rule is tried at some position the recursive call fails, then the rule is
+// tried again with the recursive call returning the previous result, while
+// the match keeps getting longer.
+//
+// The first rule of a cycle that finds the recursive call is the head and
+// grows the seed, the other rules found on the way are involved: they are
+// matched again in each round and their results are only final once the
+// head is done, even with interlocking cycles.
+
+// analyzeLeftRecursion marks the left recursive rules,
+// it fails for each cycle that can never match anything
+func analyzeLeftRecursion(rules []rule, byName map[string]*rule) ErrorList {
+	nullable := nullableRules(rules, byName)
+
+	left := map[string][]string{}
+	for k := range rules {
+		r := &rules[k]
+		for _, alt := range r.alternatives {
+			left[r.name] = append(left[r.name], alt.leftRefs(nullable)...)
+		}
+	}
+
+	all := map[string]bool{}
+	for k := range rules {
+		all[rules[k].name] = true
+	}
+
+	var errs ErrorList
+	for _, scc := range cycles(rules, left, all) {
+		in := map[string]bool{}
+		for _, v := range scc {
+			in[v] = true
+			byName[v].leftRec = true
+		}
+
+		if !hasBaseCase(scc, byName, in, nullable) {
+			r := byName[scc[0]]
+			errs = append(errs, &GrammarError{
+				Code:    CodeLeftRecursion,
+				Msg:     "left recursion without a base case: " + strings.Join(scc, ", "),
+				Line:    r.line,
+				Column:  1,
+				Rule:    r.name,
+				Snippet: r.name,
+			})
+		}
+	}
+
+	return errs
+}
+
+// hasBaseCase checks that some rule of the cycle can match
+// without calling the cycle first
+func hasBaseCase(scc []string, byName map[string]*rule, in, nullable map[string]bool) bool {
+	for _, v := range scc {
+		r := byName[v]
+		if r.allowEmpty {
+			return true
+		}
+		for _, alt := range r.alternatives {
+			base := true
+			for _, ref := range alt.leftRefs(nullable) {
+				if in[ref] {
+					base = false
+					break
+				}
+			}
+			if base {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cycles returns the strongly connected components of the graph (restricted
+// to the rules in only) that have a cycle, the rules keep the grammar order
+func cycles(rules []rule, edges map[string][]string, only map[string]bool) [][]string {
+	index := map[string]int{}
+	low := map[string]int{}
+	onStack := map[string]bool{}
+	var stack []string
+	var ret [][]string
+
+	var connect func(v string)
+	connect = func(v string) {
+		index[v] = len(index)
+		low[v] = index[v]
+		stack = append(stack, v)
+		onStack[v] = true
+
+		for _, w := range edges[v] {
+			if !only[w] {
+				continue
+			}
+			if _, seen := index[w]; !seen {
+				connect(w)
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			} else if onStack[w] && index[w] < low[v] {
+				low[v] = index[w]
+			}
+		}
+
+		if low[v] != index[v] {
+			return
+		}
+
+		var scc []string
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+
+		cyclic := len(scc) > 1
+		for _, w := range edges[v] {
+			cyclic = cyclic || w == v
+		}
+		if cyclic {
+			ret = append(ret, scc)
+		}
+	}
+
+	for k := range rules {
+		v := rules[k].name
+		if _, seen := index[v]; !seen && only[v] {
+			connect(v)
+		}
+	}
+
+	//grammar order makes the errors predictable
+	order := map[string]int{}
+	for k := range rules {
+		order[rules[k].name] = k
+	}
+	for _, scc := range ret {
+		sort.Slice(scc, func(i, j int) bool {
+			return order[scc[i]] < order[scc[j]]
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return order[ret[i][0]] < order[ret[j][0]]
+	})
+
+	return ret
+}
+
+// nullableRules finds the rules that can match without consuming anything
+func nullableRules(rules []rule, byName map[string]*rule) map[string]bool {
+	nullable := map[string]bool{}
+
+	for changed := true; changed; {
+		changed = false
+		for k := range rules {
+			r := &rules[k]
+			if nullable[r.name] {
+				continue
+			}
+
+			n := r.allowEmpty
+			for _, alt := range r.alternatives {
+				if n {
+					break
+				}
+				n = true
+				for _, it := range alt.itens {
+					if !it.nullable(nullable) {
+						n = false
+						break
+					}
+				}
+			}
+
+			if n {
+				nullable[r.name] = true
+				changed = true
+			}
+		}
+	}
+
+	return nullable
+}
+
+func (it *item) nullable(nullable map[string]bool) bool {
+	switch it.kind {
+	case itemEmpty, itemLookahead:
+		return true
+	case itemRule:
+		return nullable[it.lit]
+	case itemComplex:
+		switch c := it.cplx.(type) {
+		case *cplxRegex:
+			return (*regexp.Regexp)(c).MatchString("")
+		case *ruleRange:
+			return c.ran[0] == 0 || nullable[c.rule]
+		case *ruleKnot:
+			return nullable[c.rule]
+		}
+	}
+	return false
+}
+
+// leftRefs returns the rules the alternative may call
+// before consuming any input
+func (alt *alternative) leftRefs(nullable map[string]bool) []string {
+	var ret []string
+	for k := range alt.itens {
+		it := &alt.itens[k]
+
+		if rk, ok := it.cplx.(*ruleKnot); ok && it.kind == itemComplex {
+			ret = append(ret, rk.rule)
+			if nullable[rk.rule] {
+				ret = append(ret, rk.sep.ruleRefs()...)
+			}
+		} else {
+			ret = append(ret, it.ruleRefs()...)
+		}
+
+		if !it.nullable(nullable) {
+			break
+		}
+	}
+	return ret
+}
+
+// applyLeftRec matches a left recursive rule, following Warth et al.,
+// "Packrat Parsers Can Support Left Recursion"
+func (pe *parseEnviroment) applyLeftRec(rule string, input string) (*Node, bool) {
+	key := memoKey{
+		rule:   rule,
+		offset: pe.offset(input),
+	}
+	if m := pe.recall(rule, input, key); m != nil {
+		if m.lr != nil {
+			//a recursive call, it gets the seed
+			pe.setupLeftRec(rule, m.lr)
+			return m.lr.node, m.lr.ok
+		}
+		return m.node, m.ok
+	}
+
+	if pe.lrMemo == nil {
+		pe.lrMemo = map[memoKey]*lrEntry{}
+	}
+
+	//the seed is a failure, so the recursive call stops
+	lr := &lrFrame{rule: rule, up: pe.lrStack}
+	m := &lrEntry{lr: lr}
+	pe.lrMemo[key] = m
+	pe.lrStack = lr
+	n, ok := pe.applyRule(rule, input)
+	pe.lrStack = lr.up
+
+	if lr.head == nil {
+		//no recursion on this position
+		m.node, m.ok, m.lr = n, ok, nil
+		return n, ok
+	}
+
+	lr.node, lr.ok = n, ok
+	if lr.head.rule != rule {
+		//part of a cycle grown by another rule, the entry
+		//keeps the seed until that one is done
+		return n, ok
+	}
+
+	m.node, m.ok, m.lr = n, ok, nil
+	if !ok {
+		return nil, false
+	}
+	return pe.growLeftRec(rule, input, m, lr.head)
+}
+
+// recall finds the memoized result of a left recursive rule, while a
+// cycle is grown the rules involved are grown again once per round
+func (pe *parseEnviroment) recall(rule string, input string, key memoKey) *lrEntry {
+	m := pe.lrMemo[key]
+	h := pe.heads[key.offset]
+	if h == nil {
+		return m
+	}
+
+	if m == nil && rule != h.rule && !h.involved[rule] {
+		//not part of the cycle being grown
+		return &lrEntry{}
+	}
+
+	if h.eval[rule] {
+		delete(h.eval, rule)
+		if m == nil {
+			m = &lrEntry{}
+			pe.lrMemo[key] = m
+		}
+
+		//it may be recursive by itself, so it's grown from a failed
+		//seed with the results of the current round
+		m.node, m.ok, m.lr = nil, false, nil
+		for {
+			n, ok := pe.applyRule(rule, input)
+			if !ok || pe.err != nil || (m.ok && len(n.val) <= len(m.node.val)) {
+				break
+			}
+			m.node, m.ok = n, true
+		}
+	}
+	return m
+}
+
+// setupLeftRec marks the rules between the recursive call and the
+// rule that is called as involved in the cycle
+func (pe *parseEnviroment) setupLeftRec(rule string, lr *lrFrame) {
+	if lr.head == nil {
+		lr.head = &lrHead{
+			rule:     rule,
+			involved: map[string]bool{},
+		}
+	}
+
+	for s := pe.lrStack; s != nil && s.head != lr.head; s = s.up {
+		s.head = lr.head
+		lr.head.involved[s.rule] = true
+	}
+}
+
+// growLeftRec matches the head of a cycle again while the match
+// keeps getting longer, the rules involved are never cached as
+// final before it is done
+func (pe *parseEnviroment) growLeftRec(rule string, input string, m *lrEntry, h *lrHead) (*Node, bool) {
+	off := pe.offset(input)
+	if pe.heads == nil {
+		pe.heads = map[int]*lrHead{}
+	}
+	outer := pe.heads[off]
+	pe.heads[off] = h
+
+	for {
+		h.eval = make(map[string]bool, len(h.involved))
+		for k := range h.involved {
+			h.eval[k] = true
+		}
+
+		n, ok := pe.applyRule(rule, input)
+		if !ok || pe.err != nil || len(n.val) <= len(m.node.val) {
+			break
+		}
+		m.node = n
+	}
+
+	if outer != nil {
+		pe.heads[off] = outer
+	} else {
+		delete(pe.heads, off)
+	}
+	return m.node, m.ok
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultMaxDepth is the nesting limit of new parsers, see Parser.SetMaxDepth
+const DefaultMaxDepth = 10000
+
+// ErrDepthExceeded is what every *DepthError is
+var ErrDepthExceeded = errors.New("maximum rule depth exceeded")
+
+func (e *DepthError) Error() string {
+	return fmt.Sprintf("%s (%d) by rule %s at %s", ErrDepthExceeded, e.Max, e.Rule, e.Pos)
+}
+
+func (e *DepthError) Unwrap() error {
+	return ErrDepthExceeded
+}
+
+func (e *EncodingError) Error() string {
+	return fmt.Sprintf("invalid UTF-8 at %s", e.Pos)
+}
+
+// checkEncoding fails in strict mode if the input isn't valid UTF-8
+func (pe *parseEnviroment) checkEncoding() error {
+	if pe.parser.utf8Mode != UTF8Strict || utf8.ValidString(pe.input) {
+		return nil
+	}
+
+	s := pe.input
+	for len(s) > 0 {
+		c, l := utf8.DecodeRuneInString(s)
+		if c == utf8.RuneError && l == 1 {
+			break
+		}
+		s = s[l:]
+	}
+
+	return &EncodingError{
+		Pos: NewLineIndex(pe.input).Position(pe.offset(s)),
+	}
+}
@@ -6,6 +6,7 @@
 package mkf
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
@@ -14,35 +15,265 @@ import (
 
 //TODO save lines to have a kind of "code coverage" for the grammar
 
+// ctxCheckInterval is how many steps the matchers take between
+// checks of the context, checking it isn't free
+const ctxCheckInterval = 1024
+
+// ParseString parses the whole string, it fails if any input is left
 func (p *Parser) ParseString(s string) (*Node, error) {
-	if len(p.rules) == 0 {
-		return nil, fmt.Errorf("empty grammar")
+	pe := parseEnviroment{
+		parser: p,
+		input:  s,
+	}
+
+	return pe.parse(false)
+}
+
+// ParseContext is ParseString but gives up when ctx is done,
+// returning ctx.Err() wrapped with the position it reached
+func (p *Parser) ParseContext(ctx context.Context, s string) (*Node, error) {
+	pe := parseEnviroment{
+		parser: p,
+		input:  s,
+		ctx:    ctx,
 	}
 
+	return pe.parse(false)
+}
+
+// ParsePrefix parses the longest prefix of s the root rule matches,
+// consumed is how many bytes it took
+func (p *Parser) ParsePrefix(s string) (n *Node, consumed int, err error) {
 	pe := parseEnviroment{
 		parser: p,
+		input:  s,
+	}
+
+	n, err = pe.parse(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	return n, len(n.val), nil
+}
+
+func (pe *parseEnviroment) parse(prefix bool) (*Node, error) {
+	p := pe.parser
+	if len(p.rules) == 0 {
+		return nil, fmt.Errorf("empty grammar")
+	}
+
+	if pe.ctx != nil && pe.ctx.Err() != nil {
+		return nil, pe.ctx.Err()
+	}
+	if err := pe.checkEncoding(); err != nil {
+		return nil, err
+	}
+
+	if !prefix && p.recovery != nil {
+		return pe.recover()
 	}
 
 	root := p.rules[p.root]
 
-	n, ok := pe.matchRule(root.name, s)
+	n, ok := pe.matchRule(root.name, pe.input)
+	if pe.err != nil {
+		return nil, pe.err
+	}
 	if !ok {
-		return nil, fmt.Errorf("input doesn't match grammar")
+		return nil, pe.parseError()
 	}
 
-	//TODO what if the end of strings isn't reached?
+	if !prefix && len(n.val) != len(pe.input) {
+		if pe.fail.pos < len(n.val) {
+			//nothing failed after the end of the root, it just stopped there
+			pe.fail = failure{pos: len(n.val)}
+		}
+		return nil, pe.parseError()
+	}
 
 	return n, nil
 }
 
+// parseError describes the furthest failure
+func (pe *parseEnviroment) parseError() *ParseError {
+	var found string
+	if rest := pe.input[pe.fail.pos:]; rest != "" {
+		c, _ := utf8.DecodeRuneInString(rest)
+		found = string(c)
+	}
+
+	return &ParseError{
+		Pos:      NewLineIndex(pe.input).Position(pe.fail.pos),
+		Expected: pe.fail.expected,
+		Found:    found,
+		Stack:    pe.fail.stack.rules(),
+	}
+}
+
+// rules returns the stack as a list, the root first
+func (f *ruleFrame) rules() []string {
+	var ret []string
+	for ; f != nil; f = f.up {
+		ret = append(ret, f.rule)
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret
+}
+
+// behind reports if a failure at s doesn't need to be recorded
+func (pe *parseEnviroment) behind(s string) bool {
+	return pe.quiet > 0 || pe.offset(s) < pe.fail.pos
+}
+
+// expectItem is expect for terminals, they are only
+// written down when needed because most failures are forgotten
+func (pe *parseEnviroment) expectItem(s string, v *item) {
+	if !pe.behind(s) {
+		pe.expect(s, v.String())
+	}
+}
+
+// expect records what was expected at the start of s,
+// only the furthest failures are kept
+func (pe *parseEnviroment) expect(s string, what string) {
+	if pe.behind(s) {
+		return
+	}
+
+	off := pe.offset(s)
+	if off > pe.fail.pos || len(pe.fail.expected) == 0 {
+		pe.fail = failure{
+			pos:   off,
+			stack: pe.stack,
+		}
+	}
+
+	for _, v := range pe.fail.expected {
+		if v == what {
+			return
+		}
+	}
+	pe.fail.expected = append(pe.fail.expected, what)
+}
+
+// expectRule replaces what a rule expected at its own start by its name,
+// keep is how many expectations were there before the rule was tried
+func (pe *parseEnviroment) expectRule(rule string, input string, keep int) {
+	if pe.quiet > 0 || pe.offset(input) != pe.fail.pos {
+		//it failed further ahead, that is more useful
+		return
+	}
+
+	pe.fail.expected = pe.fail.expected[:keep]
+	pe.expect(input, rule)
+}
+
+// ruleFailed records the rule that failed at the start of input, the
+// first one at the furthest failure is the deepest
+func (pe *parseEnviroment) ruleFailed(rule string, input string) {
+	if !pe.behind(input) && pe.offset(input) == pe.fail.pos && pe.fail.rule == "" {
+		pe.fail.rule = rule
+	}
+}
+
 func (pe *parseEnviroment) matchRule(rule string, input string) (*Node, bool) {
-	pe.depth++
+	if pe.err != nil {
+		//something went really wrong, just unwind
+		return nil, false
+	}
+
+	r := pe.parser.byName[rule]
+	if r.leftRec {
+		return pe.applyLeftRec(rule, input)
+	}
+	if !pe.parser.memoize {
+		return pe.applyRule(rule, input)
+	}
+
+	key := memoKey{
+		rule:   rule,
+		offset: pe.offset(input),
+	}
+	if m, ok := pe.memo[key]; ok {
+		if !m.ok {
+			//if it failed further ahead this is ignored
+			pe.expect(input, rule)
+			pe.ruleFailed(rule, input)
+		}
+		return m.node, m.ok
+	}
+
+	n, ok := pe.applyRule(rule, input)
+	if pe.err == nil {
+		if pe.memo == nil {
+			pe.memo = map[memoKey]memoEntry{}
+		}
+		pe.memo[key] = memoEntry{
+			node: n,
+			ok:   ok,
+		}
+	}
+
+	return n, ok
+}
+
+// applyRule is matchRule without the memoization
+func (pe *parseEnviroment) applyRule(rule string, input string) (*Node, bool) {
+	ok := pe.descend(rule, input)
 	defer func() {
 		pe.depth--
 	}()
+	if !ok {
+		return nil, false
+	}
 
 	r := pe.parser.byName[rule]
+	choice := pe.parser.ruleChoice(r)
+
+	var keep int
+	if pe.fail.pos == pe.offset(input) {
+		keep = len(pe.fail.expected)
+	}
+	if pe.regions != nil && !r.leftRec && pe.reentered(rule, pe.offset(input)) {
+		return nil, false
+	}
+	pe.stack = &ruleFrame{rule: rule, off: pe.offset(input), up: pe.stack}
+	skip, missed := pe.skip, pe.missed
+	pe.skip, pe.missed = false, false
+
+	ret := pe.chooseAlternative(r, input, choice)
+	if ret == nil && pe.missed && !r.allowEmpty {
+		//only a rule that fails without them gets error nodes,
+		//so they end up in the deepest rule that failed
+		pe.skip = true
+		ret = pe.chooseAlternative(r, input, choice)
+	}
+
+	pe.skip, pe.missed = skip, missed
+	pe.stack = pe.stack.up
+
+	if ret == nil {
+		if !r.allowEmpty {
+			pe.expectRule(rule, input, keep)
+			pe.ruleFailed(rule, input)
+			return nil, false
+		}
+		//TODO improve?
+		ret = &Node{
+			rule:  rule,
+			start: pe.offset(input),
+			end:   pe.offset(input),
+		}
+	}
+
+	return ret, true
+}
 
+// chooseAlternative returns the alternative of the rule picked by
+// the choice policy, nil if none matches
+func (pe *parseEnviroment) chooseAlternative(r *rule, input string, choice Choice) *Node {
 	var ret *Node
 
 	for _, v := range r.alternatives {
@@ -50,87 +281,119 @@ func (pe *parseEnviroment) matchRule(rule string, input string) (*Node, bool) {
 		if !ok {
 			continue
 		}
-		if ret != nil && len(ret.val) > len(n.val) {
-			continue
+		if ret != nil {
+			if len(ret.val) > len(n.val) {
+				continue
+			}
+			if choice == ChoiceLongestFirstTie && len(ret.val) == len(n.val) {
+				continue
+			}
 		}
-		n.rule = rule
+		n.rule = r.name
 		ret = n
-	}
 
-	if ret == nil {
-		if r.allowEmpty {
-			//TODO improve?
-			return &Node{
-				rule: rule,
-			}, true
+		if choice == ChoiceFirst {
+			break
 		}
-		return nil, false
 	}
 
-	return ret, true
+	return ret
 }
 
 func (pe *parseEnviroment) tryAlternative(alt alternative, input string) (*Node, bool) {
-	bn := bunchOfNodes{
-		in: input,
+	if pe.interrupted(input) {
+		return nil, false
 	}
 
-	for _, v := range alt.itens {
-		s := bn.remaining()
+	bn := pe.newBunch(input)
 
-		switch v.kind {
-		case itemSimpleRuneRange, itemComplexRange:
-			n, ok := tryRune(v, s)
-			if !ok {
+	for k := range alt.itens {
+		v := &alt.itens[k]
+		n, ok := pe.matchItem(v, bn.remaining())
+		if !ok {
+			en := pe.errorNode(bn.remaining())
+			if en == nil || bn.errorAtEnd() {
 				return nil, false
 			}
-
-			bn.push(n)
-
-		case itemComplex:
-			n, ok := v.cplx.match(pe, s)
-			if !ok {
-				return nil, false
+			//if the item fails after the error, the error stands for it
+			bn.push(en)
+			if n, ok = pe.matchItem(v, bn.remaining()); !ok {
+				continue
 			}
+		}
+		if v.kind == itemLookahead {
+			//predicates only look, they leave nothing in the tree
+			continue
+		}
+		bn.push(n)
+	}
 
-			bn.push(n)
-
-		case itemRule:
-			n, ok := pe.matchRule(v.lit, s)
-			if !ok {
-				return nil, false
-			}
-			bn.push(n)
+	return bn.result(), true
+}
 
-		case itemLiteral:
-			ok := strings.HasPrefix(s, v.lit)
-			if !ok {
-				return nil, false
-			}
-			bn.push(&Node{
-				val: v.lit,
-			})
+// matchItem matches a single item of an alternative at the start of s
+func (pe *parseEnviroment) matchItem(v *item, s string) (*Node, bool) {
+	switch v.kind {
+	case itemComplex, itemLookahead:
+		return v.cplx.match(pe, s)
+	case itemRule:
+		return pe.matchRule(v.lit, s)
+	}
+	return pe.matchTerminal(v, s)
+}
 
-		default:
-			panic("item kind not implemented")
+// matchTerminal matches the items that never call rules,
+// literals and rune ranges
+func (pe *parseEnviroment) matchTerminal(v *item, s string) (*Node, bool) {
+	switch v.kind {
+	case itemSimpleRuneRange, itemComplexRange:
+		return pe.tryRune(v, s)
+
+	case itemLiteral:
+		l := len(v.lit)
+		ok := strings.HasPrefix(s, v.lit)
+		if !ok && v.fold {
+			l, ok = foldPrefix(s, v.lit)
+		}
+		if !ok {
+			pe.expectItem(s, v)
+			return nil, false
 		}
+		return &Node{
+			val: s[:l],
+		}, true
 	}
 
-	return bn.result(), true
+	panic("item kind not implemented")
 }
 
-func tryRune(v item, s string) (*Node, bool) {
-	//TODO what about the error rune?
-	c, l := utf8.DecodeRuneInString(s)
+func (pe *parseEnviroment) tryRune(v *item, s string) (*Node, bool) {
+	if s == "" {
+		pe.expectItem(s, v)
+		return nil, false
+	}
+
+	var c rune
+	l := 1
+	if pe.parser.utf8Mode == UTF8Raw {
+		c = rune(s[0])
+	} else {
+		//invalid bytes become utf8.RuneError, strict mode
+		//made sure there are none before starting
+		c, l = utf8.DecodeRuneInString(s)
+	}
 
-	var ok bool
+	inRange := v.runes.inRange
 	if v.kind == itemComplexRange {
-		vc := v.cplx.(*complexRange)
-		ok = vc.inRange(c)
-	} else {
-		ok = v.runes.inRange(c)
+		inRange = v.cplx.(*complexRange).inRange
+	}
+
+	ok := inRange(c)
+	if !ok && v.fold {
+		ok = foldInRange(c, inRange)
 	}
 	if !ok {
+		pe.expectItem(s, v)
 		return nil, false
 	}
 
@@ -140,10 +403,13 @@ func tryRune(v item, s string) (*Node, bool) {
 	}, true
 }
 
-func (cr *cplxRegex) match(_ *parseEnviroment, in string) (*Node, bool) {
+func (cr *cplxRegex) match(pe *parseEnviroment, in string) (*Node, bool) {
 	r := (*regexp.Regexp)(cr)
 	res := r.FindStringIndex(in)
 	if res == nil {
+		if !pe.behind(in) {
+			pe.expect(in, "/"+r.String()+"/")
+		}
 		return nil, false
 	}
 	if res[0] != 0 {
@@ -158,11 +424,83 @@ func (cr *cplxRegex) match(_ *parseEnviroment, in string) (*Node, bool) {
 	}, true
 }
 
+// descend counts one more level of rule nesting, it aborts the parse
+// if there are too many, the caller must decrement pe.depth either way
+func (pe *parseEnviroment) descend(rule string, input string) bool {
+	pe.depth++
+
+	max := pe.parser.maxDepth
+	if max <= 0 || pe.depth <= max {
+		return true
+	}
+
+	pe.err = &DepthError{
+		Rule: rule,
+		Max:  max,
+		Pos:  NewLineIndex(pe.input).Position(pe.offset(input)),
+	}
+	return false
+}
+
+// interrupted checks once in a while if the context is done,
+// aborting the parse if it is
+func (pe *parseEnviroment) interrupted(input string) bool {
+	if pe.ctx == nil || pe.err != nil {
+		return pe.err != nil
+	}
+
+	pe.steps++
+	if pe.steps%ctxCheckInterval != 0 {
+		return false
+	}
+
+	select {
+	case <-pe.ctx.Done():
+		pos := NewLineIndex(pe.input).Position(pe.offset(input))
+		pe.err = fmt.Errorf("parsing interrupted at %s: %w", pos, pe.ctx.Err())
+		return true
+	default:
+		return false
+	}
+}
+
+// offset returns where in the input a remaining string starts,
+// every matcher receives a suffix of the original input
+func (pe *parseEnviroment) offset(s string) int {
+	return len(pe.input) - len(s)
+}
+
+func (pe *parseEnviroment) newBunch(input string) bunchOfNodes {
+	return bunchOfNodes{
+		in:    input,
+		start: pe.offset(input),
+	}
+}
+
 func (bn *bunchOfNodes) push(n *Node) {
+	//leaves don't know where they are, so we tell them
+	n.start = bn.start + bn.nm
+	n.end = n.start + len(n.val)
+
 	bn.nm += len(n.val)
 	bn.ns = append(bn.ns, n)
 }
 
+// errorAtEnd reports if an error node ends the bunch, maybe followed
+// by empty leaves, the recovery doesn't pile them up at the same spot
+func (bn *bunchOfNodes) errorAtEnd() bool {
+	for k := len(bn.ns) - 1; k >= 0; k-- {
+		n := bn.ns[k]
+		if n.err != nil {
+			return true
+		}
+		if n.val != "" || len(n.childs) != 0 {
+			break
+		}
+	}
+	return false
+}
+
 func (bn *bunchOfNodes) remaining() string {
 	return bn.in[bn.nm:]
 }
@@ -172,5 +510,7 @@ func (bn *bunchOfNodes) result() *Node {
 	return &Node{
 		childs: bn.ns,
 		val:    val,
+		start:  bn.start,
+		end:    bn.start + bn.nm,
 	}
 }
@@ -5,7 +5,15 @@
 
 package mkf
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
 
 const testArrayParser = `
 rootRule
@@ -80,6 +88,24 @@ func TestMatch(t *testing.T) {
 	mustGoRight("[720,444,22,123,5, 123 ,123]")
 
 	mustFail("[ 720,444,22,123,5, 1z23 ,12]")
+	mustFail("[7]garbage")
+	mustFail("[7] ")
+
+	n, consumed, e := p.ParsePrefix("[7,8]garbage")
+	if e != nil {
+		t.Fatalf("Prefix should match: %s", e)
+	}
+	if consumed != 5 || n.val != "[7,8]" {
+		t.Errorf("Wrong prefix, consumed: %d, val: %s", consumed, n.val)
+	}
+	if _, _, e := p.ParsePrefix("garbage"); e == nil {
+		t.Error("Should have failed")
+	}
+
+	_, e = p.ParseString("[7,\n8]]")
+	if e == nil || !strings.Contains(e.Error(), "trailing input at 2:3") {
+		t.Errorf("Wrong trailing input error: %v", e)
+	}
 
 	p, e = NewParser(`
 rootRule
@@ -164,3 +190,978 @@ digit
 	mustFail("123123,123123,")
 
 }
+
+func TestEvaluate(t *testing.T) {
+	p, e := NewParser(`
+sum
+	num§plus
+
+plus
+	ws "+" ws
+
+num
+	digit+
+
+digit
+	'0' . '9'
+
+ws
+	""
+	/^\s+/
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+
+	e = p.Action("num", func(n *Node, kids []any) (any, error) {
+		if len(kids) > 3 {
+			return nil, errors.New("number too big")
+		}
+		return strconv.Atoi(n.Text())
+	})
+	if e != nil {
+		t.Fatalf("Should be nil: %s", e)
+	}
+	p.Action("sum", func(n *Node, kids []any) (any, error) {
+		//the actions of the nums must leave their digits in the tree
+		digits, _ := n.Query("//digit")
+		if want := strings.NewReplacer(" ", "", "+", "").Replace(n.Text()); len(digits) != len(want) {
+			return nil, fmt.Errorf("wrong number of digits: %d", len(digits))
+		}
+		total := 0
+		for _, v := range kids {
+			if i, ok := v.(int); ok {
+				total += i
+			}
+		}
+		return total, nil
+	})
+
+	v, e := p.Evaluate("1 + 20+300")
+	if e != nil {
+		t.Fatalf("Evaluate failed: %s", e)
+	}
+	if v != 321 {
+		t.Errorf("Wrong result: %v", v)
+	}
+
+	_, e = p.Evaluate("1 +\n2+ 3000")
+	var ae *ActionError
+	if !errors.As(e, &ae) {
+		t.Fatalf("Expected an action error, got: %v", e)
+	}
+	if ae.Rule != "num" || ae.Pos.Line != 2 || ae.Pos.Column != 4 {
+		t.Errorf("Wrong error position: %s", ae)
+	}
+
+	//with recovery the actions only run if nothing had to be skipped
+	p.SetRecovery(&Recovery{})
+	v, e = p.Evaluate("1 + 20+300")
+	if e != nil || v != 321 {
+		t.Errorf("Wrong result with recovery: %v, %v", v, e)
+	}
+	v, e = p.Evaluate("1 + x+300")
+	var pl ParseErrorList
+	if v != nil || !errors.As(e, &pl) {
+		t.Errorf("Expected a ParseErrorList, got: %v, %v", v, e)
+	}
+	p.SetRecovery(nil)
+
+	p.Action("sum", nil)
+	v, e = p.Evaluate("4+5")
+	if e != nil {
+		t.Fatalf("Evaluate failed: %s", e)
+	}
+	if fmt.Sprint(v) != "[4 [ + ] 5]" {
+		t.Errorf("Wrong default value: %v", v)
+	}
+
+	if p.Action("nope", nil) == nil {
+		t.Error("Expected error for an unknown rule")
+	}
+
+	//actions only run for the tree that won
+	p, e = NewParser(`
+root
+	x "!"
+	y
+
+x
+	"ab"
+
+y
+	"ab"
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	p.Action("x", func(*Node, []any) (any, error) {
+		return nil, errors.New("x shouldn't run")
+	})
+	if v, e := p.Evaluate("ab"); e != nil || v != "ab" {
+		t.Errorf("Discarded matches shouldn't run actions: %v %v", v, e)
+	}
+}
+
+func nestedArray(depth int) string {
+	return strings.Repeat("[1, ", depth) + "0x1" + strings.Repeat(" ,2]", depth)
+}
+
+func TestMemoization(t *testing.T) {
+	p, e := NewParser(testArrayParser)
+	if e != nil {
+		t.Fatalf("Should be nil: %s", e)
+	}
+
+	inputs := []string{
+		"[7]",
+		"[720,444,22,123,5, 123 ,123]",
+		"[1,[2,[3, 0x4]],5]",
+		nestedArray(8),
+	}
+
+	for _, v := range inputs {
+		p.SetMemoization(false)
+		plain := mustGoAlright(p, t, v)
+
+		p.SetMemoization(true)
+		memo := mustGoAlright(p, t, v)
+
+		if plain.String() != memo.String() {
+			t.Errorf("Memoization changed the tree:\n%s\n%s", plain, memo)
+		}
+	}
+
+	_, e = p.ParseString("[1,[2,[3, 0x4]],5")
+	if e == nil {
+		t.Error("Should have failed")
+	}
+}
+
+func BenchmarkNestedArrays(b *testing.B) {
+	p, e := NewParser(testArrayParser)
+	if e != nil {
+		b.Fatalf("Error compiling grammar: %s", e)
+	}
+
+	for _, depth := range []int{4, 8, 12} {
+		in := nestedArray(depth)
+		for _, memo := range []bool{false, true} {
+			name := fmt.Sprintf("depth=%d/memo=%v", depth, memo)
+			b.Run(name, func(b *testing.B) {
+				p.SetMemoization(memo)
+				for i := 0; i < b.N; i++ {
+					if _, e := p.ParseString(in); e != nil {
+						b.Fatal("failed parsing ", e)
+					}
+				}
+			})
+		}
+	}
+}
+
+const testExprParser = `
+expr
+	expr ws "+" ws term
+	expr ws "-" ws term
+	term
+
+term
+	term ws "*" ws factor
+	factor
+
+factor
+	/^[0-9]+/
+	"(" ws expr ws ")"
+
+ws
+	""
+	/^\s+/
+`
+
+func TestLeftRecursion(t *testing.T) {
+	p, e := NewParser(testExprParser)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+
+	calc := func(n *Node, kids []any) (any, error) {
+		if len(kids) == 1 {
+			return kids[0], nil
+		}
+		a, b := kids[0].(int), kids[4].(int)
+		switch kids[2] {
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		}
+		return a * b, nil
+	}
+	p.Action("expr", calc)
+	p.Action("term", calc)
+	p.Action("factor", func(n *Node, kids []any) (any, error) {
+		if len(kids) == 1 {
+			return strconv.Atoi(n.Text())
+		}
+		return kids[2], nil
+	})
+
+	for _, memo := range []bool{false, true} {
+		p.SetMemoization(memo)
+
+		doTest := func(in string, expected int) {
+			v, e := p.Evaluate(in)
+			if e != nil {
+				t.Errorf("Evaluating %s failed: %s", in, e)
+			} else if v != expected {
+				t.Errorf("Wrong result for %s, expected: %d, got: %v", in, expected, v)
+			}
+		}
+
+		doTest("7", 7)
+		doTest("1-2-3", -4)
+		doTest("2*3+4*5", 26)
+		doTest("10 - (2 - 3) * 4", 14)
+		doTest("((1))", 1)
+
+		if _, e := p.Evaluate("1+"); e == nil {
+			t.Error("Should have failed")
+		}
+
+		n := mustGoAlright(p, t, "1-2-3")
+		left := n.childs[0]
+		if left.rule != "expr" || left.val != "1-2" {
+			t.Errorf("Tree isn't left associative: %s", n)
+		}
+	}
+
+	p, e = NewParser(`
+a
+	b "x"
+	"y"
+
+b
+	a "z"
+	"w"
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	for _, memo := range []bool{false, true} {
+		p.SetMemoization(memo)
+		mustGoAlright(p, t, "y")
+		mustGoAlright(p, t, "wx")
+		mustGoAlright(p, t, "yzx")
+		mustGoAlright(p, t, "wxzxzx")
+		if _, e := p.ParseString("yz"); e == nil {
+			t.Error("Should have failed")
+		}
+	}
+
+	//interlocking cycles
+	p, e = NewParser(`
+s
+	s "a"
+	t "b"
+	"c"
+
+t
+	s "d"
+	t "e"
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	for _, memo := range []bool{false, true} {
+		p.SetMemoization(memo)
+		mustGoAlright(p, t, "c")
+		mustGoAlright(p, t, "ca")
+		mustGoAlright(p, t, "cdb")
+		mustGoAlright(p, t, "cdeb")
+		mustGoAlright(p, t, "cdebadeeba")
+		if _, e := p.ParseString("cd"); e == nil {
+			t.Error("Should have failed")
+		}
+		n, e := p.ParseString("cdeb")
+		if e != nil || n.String() != `(s (t (t (s "c") "d") "e") "b")` {
+			t.Errorf("Wrong tree: %s, %v", n, e)
+		}
+	}
+
+	doTestError := func(grammar string) {
+		if _, e := NewParser(grammar); e == nil {
+			t.Errorf("Expected error for:%s", grammar)
+		}
+	}
+
+	doTestError("a\n\ta \"x\"\n")
+	doTestError("a\n\tb \"x\"\nb\n\ta \"y\"\n")
+	doTestError("a\n\tb+ \"x\"\nb\n\tc\nc\n\ta\n")
+}
+
+func TestChoice(t *testing.T) {
+	const grammar = `
+root
+	pick rest
+
+pick%s
+	a
+	b
+	"xy"
+
+a
+	"x"
+
+b
+	/^x/
+
+rest
+	""
+	/^y/
+`
+	doTest := func(annotation string, parser Choice, expected string) {
+		p, e := NewParser(fmt.Sprintf(grammar, annotation))
+		if e != nil {
+			t.Fatalf("Failed creating parser, should be nil: %s", e)
+		}
+		p.SetChoice(parser)
+
+		n, e := p.ParseString("xy")
+		if e != nil {
+			t.Errorf("Parsing failed (%q, %s): %s", annotation, parser, e)
+			return
+		}
+		if s := n.childs[0].String(); s != expected {
+			t.Errorf("Wrong choice (%q, %s), expected: %s, got: %s", annotation, parser, expected, s)
+		}
+	}
+
+	doTest("", ChoiceDefault, `(pick "xy")`)
+	doTest("", ChoiceLongest, `(pick "xy")`)
+	doTest("", ChoiceFirst, `(pick (a "x"))`)
+	doTest(" @first", ChoiceLongest, `(pick (a "x"))`)
+	doTest(" @longest", ChoiceFirst, `(pick "xy")`)
+
+	//without the literal, the longest ones are a tie
+	tie := strings.Replace(grammar, "\t\"xy\"\n", "", 1)
+	p, e := NewParser(fmt.Sprintf(tie, ""))
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	for c, expected := range map[Choice]string{
+		ChoiceLongest:         "b",
+		ChoiceFirst:           "a",
+		ChoiceLongestFirstTie: "a",
+	} {
+		p.SetChoice(c)
+		n := mustGoAlright(p, t, "xy")
+		if r := n.childs[0].childs[0].rule; r != expected {
+			t.Errorf("Wrong tie breaking for %s, expected: %s, got: %s", c, expected, r)
+		}
+	}
+
+	p, e = NewParser(fmt.Sprintf(grammar, " @longest-first-tie"))
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	p.SetChoice(ChoiceFirst)
+	if info, ok := p.Rule("pick"); !ok || info.Choice != ChoiceLongestFirstTie || info.Alternatives != 3 {
+		t.Errorf("Wrong rule info: %+v", info)
+	}
+	if info, _ := p.Rule("rest"); info.Choice != ChoiceFirst || !info.AllowEmpty {
+		t.Errorf("Wrong rule info: %+v", info)
+	}
+	if len(p.Rules()) != 5 || p.Rules()[0].Name != "root" {
+		t.Error("Wrong rules")
+	}
+
+	if _, e := NewParser(fmt.Sprintf(grammar, " @shortest")); e == nil {
+		t.Error("Expected error for an unknown annotation")
+	}
+}
+
+func TestParseForest(t *testing.T) {
+	doTest := func(grammar, in string, expected ...string) {
+		p, e := NewParser(grammar)
+		if e != nil {
+			t.Fatalf("Failed creating parser, should be nil: %s", e)
+		}
+
+		trees, e := p.ParseAll(in)
+		if e != nil {
+			t.Errorf("Parsing %s failed: %s", in, e)
+			return
+		}
+
+		var got []string
+		for _, v := range trees {
+			if v.val != in || v.end != len(in) {
+				t.Errorf("Wrong tree span: %s", v)
+			}
+			got = append(got, v.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Wrong trees for %s\nexpected:\n%s\ngot:\n%s", in,
+				strings.Join(expected, "\n"), strings.Join(got, "\n"))
+		}
+
+		f, _ := p.ParseForest(in)
+		if f.Ambiguous() != (len(expected) > 1) {
+			t.Errorf("Wrong ambiguity for %s", in)
+		}
+	}
+
+	const sum = `
+e
+	e "+" e
+	/^[0-9]/
+`
+	doTest(sum, "1", `(e "1")`)
+	doTest(sum, "1+2+3",
+		`(e (e "1") "+" (e (e "2") "+" (e "3")))`,
+		`(e (e (e "1") "+" (e "2")) "+" (e "3"))`,
+	)
+
+	p, _ := NewParser(sum)
+	trees, _ := p.ParseAll("1+2+3+4+5")
+	if len(trees) != 14 {
+		t.Errorf("Wrong number of trees: %d", len(trees))
+	}
+
+	doTest(`
+s
+	a b
+a
+	"x"
+	"xx"
+b
+	"x"
+	"xx"
+`, "xxx",
+		`(s (a "x") (b "xx"))`,
+		`(s (a "xx") (b "x"))`,
+	)
+
+	doTest(`
+s
+	w+
+w
+	'a'
+	"aa"
+`, "aaa",
+		`(s (w "a") (w "aa"))`,
+		`(s (w "aa") (w "a"))`,
+		`(s (w "a") (w "a") (w "a"))`,
+	)
+
+	doTest(`
+s
+	w§'-'
+w
+	/^[a-z]+/
+	w '-' w
+`, "a-b", `(s (w (w "a") "-" (w "b")))`, `(s (w "a") "-" (w "b"))`)
+
+	//the cycle a -> b -> a only adds trees going around in circles
+	p, e := NewParser(`
+a
+	b
+	"x"
+b
+	""
+	a
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	trees, _ = p.ParseAll("x")
+	if len(trees) != 1 || trees[0].String() != `(a "x")` {
+		t.Errorf("Wrong trees: %v", trees)
+	}
+
+	p, _ = NewParser(testExprParser)
+	for _, in := range []string{"1", "1 - 2*3", "(1+2)*3 - 4"} {
+		trees, e := p.ParseAll(in)
+		if e != nil || len(trees) != 1 {
+			t.Errorf("Expected a single tree for %s: %v", in, e)
+			continue
+		}
+		n := mustGoAlright(p, t, in)
+		if n.String() != trees[0].String() {
+			t.Errorf("Forest and parser disagree:\n%s\n%s", n, trees[0])
+		}
+	}
+
+	p, _ = NewParser(sum)
+	if _, e := p.ParseAll("1+"); e == nil {
+		t.Error("Should have failed")
+	}
+
+	//the trees are exponentially many, the forest must not be
+	for _, grammar := range []string{`
+root
+	x*
+
+x
+	"a"
+	"aa"
+`, `
+root
+	x§sep
+
+x
+	"a"
+	"aa"
+
+sep
+	""
+	","
+`} {
+		p, e := NewParser(grammar)
+		if e != nil {
+			t.Fatalf("Failed creating parser, should be nil: %s", e)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, e := p.ParseForest(strings.Repeat("a", 200))
+			done <- e
+		}()
+		select {
+		case e := <-done:
+			if e != nil {
+				t.Errorf("Parsing failed: %s", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The forest isn't shared:%s", grammar)
+		}
+
+		if trees, _ := p.ParseAll("aaaaaa"); len(trees) != 13 {
+			t.Errorf("Wrong number of trees: %d", len(trees))
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	p, e := NewParser(testArrayParser)
+	if e != nil {
+		t.Fatalf("Should be nil: %s", e)
+	}
+
+	hostile := strings.Repeat("[", 100000)
+	for _, memo := range []bool{false, true} {
+		p.SetMemoization(memo)
+
+		_, e = p.ParseString(hostile)
+		var de *DepthError
+		if !errors.As(e, &de) || !errors.Is(e, ErrDepthExceeded) {
+			t.Fatalf("Expected a depth error, got: %v", e)
+		}
+		if de.Max != DefaultMaxDepth || de.Pos.Offset == 0 || de.Pos.Line != 1 {
+			t.Errorf("Wrong depth error: %s", de)
+		}
+	}
+
+	in := nestedArray(40)
+	p.SetMaxDepth(40)
+	if _, e := p.ParseString(in); !errors.Is(e, ErrDepthExceeded) {
+		t.Errorf("Expected a depth error, got: %v", e)
+	}
+	if _, e := p.ParseForest(in); !errors.Is(e, ErrDepthExceeded) {
+		t.Errorf("Expected a depth error from the forest, got: %v", e)
+	}
+
+	p.SetMaxDepth(0)
+	mustGoAlright(p, t, in)
+	if _, e := p.ParseForest(in); e != nil {
+		t.Errorf("Forest should have worked: %s", e)
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	//e* never stops matching nothing, until it does it 2^31 times
+	p, e := NewParser(`
+s
+	e* "x"
+
+e
+	""
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, e = p.ParseContext(ctx, "x")
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got: %v", e)
+	}
+	if !strings.Contains(e.Error(), "at 1:1") {
+		t.Errorf("Error should have the position: %s", e)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Took too long to give up")
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, e := p.ParseContext(canceled, "x"); !errors.Is(e, context.Canceled) {
+		t.Errorf("Expected a canceled error, got: %v", e)
+	}
+
+	p, _ = NewParser(testArrayParser)
+	n, e := p.ParseContext(context.Background(), "[1,2]")
+	if e != nil || n.val != "[1,2]" {
+		t.Errorf("Should have parsed: %v", e)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	const (
+		fails = iota
+		matches
+		encoding
+	)
+
+	doTest := func(grammar, in string, replace, strict, raw int) {
+		p, e := NewParser("root\n\t" + grammar + "\nc\n\t'0080' . '00FF'\n")
+		if e != nil {
+			t.Fatalf("Failed creating parser, should be nil: %s", e)
+		}
+
+		for mode, expected := range map[UTF8Mode]int{
+			UTF8Replace: replace,
+			UTF8Strict:  strict,
+			UTF8Raw:     raw,
+		} {
+			p.SetUTF8Mode(mode)
+			_, e := p.ParseString(in)
+
+			got := matches
+			var ee *EncodingError
+			switch {
+			case errors.As(e, &ee):
+				got = encoding
+				if ee.Pos.Offset != strings.IndexByte(in, 0xff) {
+					t.Errorf("Wrong position for %s: %s", grammar, e)
+				}
+			case e != nil:
+				got = fails
+			}
+
+			if got != expected {
+				t.Errorf("Wrong result for %s on %q in mode %d: %v", grammar, in, mode, e)
+			}
+		}
+	}
+
+	doTest(`"a"`, "\xff", fails, encoding, fails)
+	doTest(`'FFFD'`, "\xff", matches, encoding, fails)
+	doTest(`'FFFD'`, "�", matches, matches, fails)
+	doTest(`c`, "\xff", fails, encoding, matches)
+	doTest(`c`, "ÿ", matches, matches, fails)
+	doTest(`'0001' . '10FFFF' - 'a'`, "\xff", matches, encoding, matches)
+	doTest(`/^./`, "\xff", matches, encoding, matches)
+	doTest(`"a" c+`, "a\xff\xfe", fails, encoding, matches)
+	doTest(`c§','`, "\xff,\xfe", fails, encoding, matches)
+
+	//there is nothing to decode at the end of the input
+	doTest(`"a" 'FFFD'`, "a", fails, fails, fails)
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	p, e := NewParser(`
+query
+	"select"i ws word ws "from"i ws word
+
+word
+	letter+
+
+letter
+	'a' . 'z'i
+	'ǆ'i
+
+ws
+	/^\s+/
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+
+	n := mustGoAlright(p, t, "SeLeCt Name FROM users")
+	if n.childs[0].val != "SeLeCt" {
+		t.Errorf("Wrong literal node: %s", n.childs[0].val)
+	}
+
+	mustGoAlright(p, t, "select ǅǄǆ from x")
+
+	//the kelvin sign folds to k, and is longer than it
+	mustGoAlright(p, t, "select K from x")
+
+	for _, v := range []string{"selec x from y", "select x fromy", "select 1 from x", "selectx from y"} {
+		if _, e := p.ParseString(v); e == nil {
+			t.Errorf("Should have failed: %s", v)
+		}
+	}
+}
+
+func TestLookahead(t *testing.T) {
+	p, e := NewParser(`
+stmts
+	stmt+
+
+stmt
+	keyword ws
+	call ws
+	name ws
+
+keyword
+	"if" !letter
+	"else" !letter
+
+call
+	name &"(" args
+
+args
+	"(" ")"
+
+name
+	!keyword letter+
+
+letter
+	'a' . 'z'
+
+ws
+	/^\s*/
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+
+	n := mustGoAlright(p, t, "if ifx foo() else elsewhere").Child(0)
+	want := []string{"keyword", "name", "call", "keyword", "name"}
+	if n.Len() != len(want) {
+		t.Fatalf("Wrong number of statements: %d", n.Len())
+	}
+	for k, v := range want {
+		got := n.Child(k).Child(0).Rule()
+		if got != v {
+			t.Errorf("Statement %d should be %s, got %s", k, v, got)
+		}
+	}
+
+	//the predicate leaves nothing behind
+	call := n.Child(2).Child(0)
+	if call.Len() != 2 || call.Child(1).Rule() != "args" {
+		t.Errorf("Wrong call node: %v", call)
+	}
+
+	if _, e := p.ParseString("foo("); e == nil {
+		t.Errorf("Should have failed")
+	}
+
+	for _, v := range []string{`& x`, `x !`, `!!x`, `!"a"i & 'b'`} {
+		_, e := NewParser("r\n\t" + v + "\n\nx\n\t\"x\"\n")
+		if e == nil {
+			t.Errorf("Should have failed: %s", v)
+		}
+	}
+
+	_, e = NewParser("r\n\t!\"a\"i &'b' . 'c' !/^x/ x\n\nx\n\t\"x\"\n")
+	if e != nil {
+		t.Errorf("Should be nil: %s", e)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	p, e := NewParser(`
+list
+	'[' item§',' ']'
+
+item
+	digit+
+	"none"i
+	/^0x[0-9a-f]+/
+
+digit
+	'0' . '9'
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+
+	_, e = p.ParseString("[1,22,none,333z]")
+	var pe *ParseError
+	if !errors.As(e, &pe) {
+		t.Fatalf("Expected a ParseError, got: %v", e)
+	}
+	if e.Error() != "expected digit, ',' or ']' at 1:15, found 'z'" {
+		t.Errorf("Wrong message: %s", e)
+	}
+	if pe.Pos.Offset != 14 || pe.Found != "z" {
+		t.Errorf("Wrong position: %d %q", pe.Pos.Offset, pe.Found)
+	}
+	if strings.Join(pe.Stack, " ") != "list item" {
+		t.Errorf("Wrong stack: %v", pe.Stack)
+	}
+
+	for in, want := range map[string]string{
+		"[1,2,]":  `expected item at 1:6, found ']'`,
+		"[1,2":    `expected digit, ',' or ']' at 1:5, found end of input`,
+		"":        `expected list at 1:1, found end of input`,
+		"[1]x":    `unexpected trailing input at 1:4, found 'x'`,
+		"[0xz]":   `expected digit, ',' or ']' at 1:3, found 'x'`,
+		"[NONEx]": `expected ',' or ']' at 1:6, found 'x'`,
+		"[1,nOz]": `expected item at 1:4, found 'n'`,
+	} {
+		_, e := p.ParseString(in)
+		if e == nil || e.Error() != want {
+			t.Errorf("Wrong error for %q, expected: %s, got: %v", in, want, e)
+		}
+	}
+
+	_, e = p.ParseForest("[1,22,none,333z]")
+	if !errors.As(e, &pe) || pe.Pos.Offset != 14 {
+		t.Errorf("Expected a ParseError from the forest, got: %v", e)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	p, e := NewParser(`
+list
+	'[' item§',' ']'
+
+item @first
+	ws digit+ ws
+	ws list ws
+
+digit
+	'0' . '9'
+
+ws
+	/^ */
+`)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	if e := p.SetRecovery(&Recovery{Rules: []string{"nope"}}); e == nil {
+		t.Error("Unknown sync rules should fail")
+	}
+	if e := p.SetRecovery(&Recovery{Literals: []string{",", "]"}}); e != nil {
+		t.Fatalf("Should be nil: %s", e)
+	}
+
+	mustGoAlright(p, t, "[1, [2, 3], 4]")
+
+	errorTexts := func(n *Node) []string {
+		var ret []string
+		Walk(n, WalkFunc(func(n *Node) (bool, error) {
+			if n.IsError() {
+				ret = append(ret, n.Text())
+			}
+			return false, nil
+		}))
+		return ret
+	}
+
+	for in, want := range map[string][]string{
+		"[1, x, 3]":     {"x"},
+		"[1, x, 3 y]":   {"x", "y"},
+		"[1 ? 2, 3]":    {"? 2"},
+		"[1,,3]":        {""},
+		"[1, [2 z], 3]": {"z"},
+		"[1, 2":         {""},
+		"[1]oops":       {"oops"},
+	} {
+		n, e := p.ParseString(in)
+		var l ParseErrorList
+		if !errors.As(e, &l) || len(l) != len(want) {
+			t.Errorf("Wrong errors for %q: %v", in, e)
+			continue
+		}
+		if n == nil || n.Text() != in {
+			t.Errorf("The tree should cover %q: %v", in, n)
+			continue
+		}
+		if got := errorTexts(n); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Wrong error nodes for %q, expected: %q, got: %q", in, want, got)
+		}
+	}
+
+	//the error is where a list should start, so it goes on looking for the rest
+	n, e := p.ParseString("garbage")
+	if e == nil || n == nil || !n.Child(0).IsError() || n.Child(0).Text() != "garbage" {
+		t.Errorf("Wrong recovery of garbage: %v %v", e, n)
+	}
+
+	n, e = p.ParseString("[1, x, 3]")
+	var pe *ParseError
+	if !errors.As(e, &pe) || pe.Pos.Offset != 4 {
+		t.Fatalf("Wrong error: %v", e)
+	}
+	if items, _ := n.Query("//item"); len(items) != 3 {
+		t.Errorf("The items around the error should be there: %d", len(items))
+	}
+
+	p.SetRecovery(&Recovery{Rules: []string{"digit"}})
+	n, e = p.ParseString("[1, xy3]")
+	if e == nil || fmt.Sprint(errorTexts(n)) != "[xy]" {
+		t.Errorf("Wrong recovery with a sync rule: %v %q", e, errorTexts(n))
+	}
+
+	p.SetRecovery(nil)
+	if _, e := p.ParseString("[1, x, 3]"); !errors.As(e, &pe) {
+		t.Errorf("Without recovery it should be a ParseError: %v", e)
+	}
+
+	//the error nodes go in the deepest rule that failed, not in the optional ws
+	p, e = NewParser(testExprParser)
+	if e != nil {
+		t.Fatalf("Failed creating parser, should be nil: %s", e)
+	}
+	p.SetRecovery(&Recovery{Literals: []string{"+", ")"}})
+
+	errorParents := func(n *Node) []string {
+		var ret []string
+		Walk(n, WalkFunc(func(n *Node) (bool, error) {
+			for _, v := range n.Children() {
+				if v.IsError() {
+					ret = append(ret, n.Rule()+" "+v.Text())
+				}
+			}
+			return false, nil
+		}))
+		return ret
+	}
+
+	for in, want := range map[string]struct {
+		tree    string
+		parents []string
+	}{
+		"1+x+3": {
+			`(expr (expr (expr (term (factor "1"))) (ws) "+" (ws) (term (factor !"x"))) (ws) "+" (ws) (term (factor "3")))`,
+			[]string{"factor x"},
+		},
+		"1+(2*)+3": {
+			`(expr (expr (expr (term (factor "1"))) (ws) "+" (ws) (term (factor "(" (ws) (expr (term (term (factor "2")) (ws) "*" (ws) (factor !""))) (ws) ")"))) (ws) "+" (ws) (term (factor "3")))`,
+			[]string{"factor "},
+		},
+	} {
+		n, e := p.ParseString(in)
+		var l ParseErrorList
+		if !errors.As(e, &l) || len(l) != 1 {
+			t.Errorf("Wrong errors for %q: %v", in, e)
+			continue
+		}
+		if n.String() != want.tree {
+			t.Errorf("Wrong tree for %q: %s", in, n)
+		}
+		if got := errorParents(n); fmt.Sprint(got) != fmt.Sprint(want.parents) {
+			t.Errorf("Wrong error nodes for %q, expected: %q, got: %q", in, want.parents, got)
+		}
+	}
+}
@@ -11,9 +11,7 @@ import (
 )
 
 func (k *ruleKnot) match(pe *parseEnviroment, input string) (*Node, bool) {
-	bn := bunchOfNodes{
-		in: input,
-	}
+	bn := pe.newBunch(input)
 
 	n, ok := pe.matchRule(k.rule, input)
 	if !ok {
@@ -22,43 +20,89 @@ func (k *ruleKnot) match(pe *parseEnviroment, input string) (*Node, bool) {
 	bn.push(n)
 
 	for {
-		var sep *Node
-		var ok bool
-		switch k.sep.kind {
-		case itemRule:
-			sep, ok = pe.matchRule(k.sep.lit, bn.remaining())
-		case itemSimpleRuneRange:
-			sep, ok = tryRune(k.sep, bn.remaining())
-		}
+		rem := bn.remaining()
+		sep, ok := k.matchSep(pe, rem)
+
+		var skipped *Node
 		if !ok {
-			break
+			skipped = pe.errorNode(rem)
+			if skipped == nil {
+				break
+			}
+			rem = rem[len(skipped.val):]
+			//if the separator fails after the error, the error stands for it
+			sep, ok = k.matchSep(pe, rem)
 		}
 
-		uRem := bn.remaining()[len(sep.val):]
-		next, ok := pe.matchRule(k.rule, uRem)
-		if !ok {
+		uRem := rem
+		if ok {
+			uRem = rem[len(sep.val):]
+		}
+		next, nok := pe.matchRule(k.rule, uRem)
+		if !nok {
+			break
+		}
+		if len(uRem) == len(bn.remaining()) && next.val == "" {
+			//it would go on forever
 			break
 		}
 
-		bn.push(sep)
+		if skipped != nil {
+			bn.push(skipped)
+		}
+		if ok {
+			bn.push(sep)
+		}
 		bn.push(next)
 	}
 
 	return bn.result(), true
 }
 
-func (r *ruleRange) match(pe *parseEnviroment, input string) (*Node, bool) {
-	bn := bunchOfNodes{
-		in: input,
+// match succeeds without consuming anything when the item matches,
+// or when it doesn't for the negative predicate
+func (l *lookahead) match(pe *parseEnviroment, input string) (*Node, bool) {
+	pe.quiet++
+	_, ok := pe.matchItem(&l.it, input)
+	pe.quiet--
+	if pe.err != nil {
+		return nil, false
+	}
+	if ok == l.neg {
+		return nil, false
 	}
 
+	return &Node{}, true
+}
+
+func (k *ruleKnot) matchSep(pe *parseEnviroment, input string) (*Node, bool) {
+	switch k.sep.kind {
+	case itemRule:
+		return pe.matchRule(k.sep.lit, input)
+	case itemSimpleRuneRange:
+		return pe.tryRune(&k.sep, input)
+	}
+	return nil, false
+}
+
+func (r *ruleRange) match(pe *parseEnviroment, input string) (*Node, bool) {
+	bn := pe.newBunch(input)
+
 	var matched int32
 	for i := 0; i < int(r.ran[1]); i++ {
 		rem := bn.remaining()
+		if pe.interrupted(rem) {
+			return nil, false
+		}
 		n, ok := pe.matchRule(r.rule, rem)
 		if !ok {
 			break
 		}
+		if pe.regions != nil && n.val == "" && matched >= r.ran[0] {
+			//an error node standing for something missing
+			//would be matched again and again
+			break
+		}
 		matched++
 		bn.push(n)
 	}
@@ -100,3 +144,20 @@ func mkRuleRange(rule string, rg string) *ruleRange {
 
 	return ret
 }
+
+// String returns the quantifier as written in the grammar
+func (r *ruleRange) String() string {
+	switch r.ran {
+	case [2]int32{0, 1}:
+		return "?"
+	case [2]int32{1, math.MaxInt32}:
+		return "+"
+	case [2]int32{0, math.MaxInt32}:
+		return "*"
+	}
+
+	if r.ran[0] == r.ran[1] {
+		return fmt.Sprintf("{%d}", r.ran[0])
+	}
+	return fmt.Sprintf("{%d,%d}", r.ran[0], r.ran[1])
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+// Rule returns the name of the rule that produced the node,
+// literals, rune ranges and other anonymous nodes return ""
+func (n *Node) Rule() string {
+	return n.rule
+}
+
+// Text returns the part of the input matched by the node
+func (n *Node) Text() string {
+	return n.val
+}
+
+// Children returns a copy of the node children
+func (n *Node) Children() []*Node {
+	if len(n.childs) == 0 {
+		return nil
+	}
+
+	ret := make([]*Node, len(n.childs))
+	copy(ret, n.childs)
+	return ret
+}
+
+// Child returns the i-th child, or nil if it doesn't exist
+func (n *Node) Child(i int) *Node {
+	if i < 0 || i >= len(n.childs) {
+		return nil
+	}
+	return n.childs[i]
+}
+
+// Len returns how many children the node has
+func (n *Node) Len() int {
+	return len(n.childs)
+}
+
+// IsLeaf reports whether the node has no children
+func (n *Node) IsLeaf() bool {
+	return len(n.childs) == 0
+}
+
+// FirstChildByRule returns the first direct child produced by the rule,
+// or nil if there is none
+func (n *Node) FirstChildByRule(name string) *Node {
+	for _, v := range n.childs {
+		if v.rule == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// ChildrenByRule returns every direct child produced by the rule
+func (n *Node) ChildrenByRule(name string) []*Node {
+	var ret []*Node
+	for _, v := range n.childs {
+		if v.rule == name {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// Start returns the byte offset in the input where the node begins
+func (n *Node) Start() int {
+	return n.start
+}
+
+// End returns the byte offset in the input right after the node
+func (n *Node) End() int {
+	return n.end
+}
+
+// IsError reports whether the node was made by the error recovery
+func (n *Node) IsError() bool {
+	return n.err != nil
+}
+
+// Err returns the error that made the error recovery skip the text
+// of the node, nil for the other nodes
+func (n *Node) Err() *ParseError {
+	return n.err
+}
@@ -0,0 +1,695 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	mkf "go-mkf-parser"
+)
+
+const testPairGrammar = `
+pair
+	key "=" value
+
+key
+	/^[a-z]+/
+
+value
+	digit+
+	"none"
+
+digit
+	'0' . '9'
+`
+
+func mustParse(t *testing.T, grammar, input string) *mkf.Node {
+	t.Helper()
+
+	p, e := mkf.NewParser(grammar)
+	if e != nil {
+		t.Fatalf("Error compiling grammar: %s", e)
+	}
+	n, e := p.ParseString(input)
+	if e != nil {
+		t.Fatalf("Error parsing %q: %s", input, e)
+	}
+	return n
+}
+
+func TestNodeAccessors(t *testing.T) {
+	n := mustParse(t, testPairGrammar, "abc=123")
+
+	if n.Rule() != "pair" {
+		t.Errorf("Wrong rule, expected: pair, got: %s", n.Rule())
+	}
+	if n.Text() != "abc=123" {
+		t.Errorf("Wrong text: %s", n.Text())
+	}
+	if n.Len() != 3 || n.IsLeaf() {
+		t.Fatalf("Wrong number of children: %d", n.Len())
+	}
+
+	key := n.FirstChildByRule("key")
+	if key == nil || key.Text() != "abc" {
+		t.Fatal("key not found")
+	}
+
+	eq := n.Child(1)
+	if eq.Rule() != "" || eq.Text() != "=" || !eq.IsLeaf() {
+		t.Errorf("Wrong literal node: %q %q", eq.Rule(), eq.Text())
+	}
+	if n.Child(3) != nil || n.Child(-1) != nil {
+		t.Error("Out of range child should be nil")
+	}
+
+	value := n.FirstChildByRule("value")
+	if value == nil || value.Text() != "123" {
+		t.Fatal("value not found")
+	}
+	if n.FirstChildByRule("digit") != nil {
+		t.Error("digit isn't a direct child")
+	}
+
+	digits := value.Child(0).ChildrenByRule("digit")
+	if len(digits) != 3 {
+		t.Fatalf("Wrong number of digits: %d", len(digits))
+	}
+	for k, v := range digits {
+		if v.Text() != "123"[k:k+1] {
+			t.Errorf("Wrong digit: %s", v.Text())
+		}
+	}
+
+	ch := n.Children()
+	ch[0] = nil
+	if n.Child(0) == nil {
+		t.Error("Children should return a copy")
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	n := mustParse(t, testPairGrammar, "abc=123")
+
+	if n.Start() != 0 || n.End() != 7 {
+		t.Errorf("Wrong root span: %d-%d", n.Start(), n.End())
+	}
+
+	value := n.FirstChildByRule("value")
+	if value.Start() != 4 || value.End() != 7 {
+		t.Errorf("Wrong value span: %d-%d", value.Start(), value.End())
+	}
+
+	digits := value.Child(0).ChildrenByRule("digit")
+	for k, v := range digits {
+		if v.Start() != 4+k || v.End() != 5+k {
+			t.Errorf("Wrong digit span: %d-%d", v.Start(), v.End())
+		}
+		leaf := v.Child(0)
+		if leaf.Start() != v.Start() || leaf.End() != v.End() {
+			t.Errorf("Wrong leaf span: %d-%d", leaf.Start(), leaf.End())
+		}
+	}
+}
+
+func TestLineIndex(t *testing.T) {
+	src := "ab\nçã=1\r\n\nz"
+	li := mkf.NewLineIndex(src)
+
+	doTest := func(off, line, col, bcol int) {
+		p := li.Position(off)
+		if p.Offset != off || p.Line != line || p.Column != col || p.ByteColumn != bcol {
+			t.Errorf("Wrong position for offset %d: %+v", off, p)
+		}
+	}
+
+	doTest(0, 1, 1, 1)
+	doTest(2, 1, 3, 3)
+	doTest(3, 2, 1, 1)
+	doTest(5, 2, 2, 3)
+	doTest(7, 2, 3, 5)
+	doTest(11, 3, 1, 1)
+	doTest(12, 4, 1, 1)
+
+	if s := li.Position(7).String(); s != "2:3" {
+		t.Errorf("Wrong string: %s", s)
+	}
+	if li.Lines() != 4 {
+		t.Errorf("Wrong line count: %d", li.Lines())
+	}
+	if l := li.Line(2); l != "çã=1" {
+		t.Errorf("Wrong line: %q", l)
+	}
+}
+
+type testVisitor struct {
+	events []string
+	skip   string
+	stop   string
+}
+
+func (v *testVisitor) Enter(n *mkf.Node) (bool, error) {
+	if n.Rule() == "" {
+		return false, nil
+	}
+	v.events = append(v.events, "+"+n.Rule())
+	if n.Rule() == v.stop {
+		return false, mkf.SkipAll
+	}
+	return n.Rule() == v.skip, nil
+}
+
+func (v *testVisitor) Exit(n *mkf.Node) error {
+	if n.Rule() != "" {
+		v.events = append(v.events, "-"+n.Rule())
+	}
+	return nil
+}
+
+func TestWalk(t *testing.T) {
+	n := mustParse(t, testPairGrammar, "ab=12")
+
+	doTest := func(v *testVisitor, expected string) {
+		if err := mkf.Walk(n, v); err != nil {
+			t.Fatalf("Walk failed: %s", err)
+		}
+		got := strings.Join(v.events, " ")
+		if got != expected {
+			t.Errorf("Wrong walk, expected: %s, got: %s", expected, got)
+		}
+	}
+
+	doTest(&testVisitor{},
+		"+pair +key -key +value +digit -digit +digit -digit -value -pair")
+	doTest(&testVisitor{skip: "value"},
+		"+pair +key -key +value -value -pair")
+	doTest(&testVisitor{stop: "value"},
+		"+pair +key -key +value")
+
+	var leaves []string
+	err := mkf.Walk(n, mkf.WalkFunc(func(n *mkf.Node) (bool, error) {
+		if n.IsLeaf() {
+			leaves = append(leaves, n.Text())
+		}
+		return false, nil
+	}))
+	if err != nil {
+		t.Fatalf("Walk failed: %s", err)
+	}
+	if got := strings.Join(leaves, ","); got != "ab,=,1,2" {
+		t.Errorf("Wrong leaves: %s", got)
+	}
+
+	err = mkf.Walk(n, mkf.WalkFunc(func(n *mkf.Node) (bool, error) {
+		return false, fmt.Errorf("stop at %s: %w", n.Rule(), mkf.SkipAll)
+	}))
+	if err != nil {
+		t.Errorf("A wrapped SkipAll should stop the walk, got: %v", err)
+	}
+
+	boom := errors.New("boom")
+	err = mkf.Walk(n, mkf.WalkFunc(func(n *mkf.Node) (bool, error) {
+		return false, boom
+	}))
+	if err != boom {
+		t.Errorf("Expected the visitor error, got: %v", err)
+	}
+}
+
+const testListGrammar = `
+list
+	'[' values ']'
+
+values
+	element
+	element ',' values
+
+element
+	number
+	list
+
+number
+	/^0x[0-9a-f]+/
+	digit+
+
+digit
+	'0' . '9'
+`
+
+func TestQuery(t *testing.T) {
+	n := mustParse(t, testListGrammar, "[1,[2,0x3],45]")
+
+	doTest := func(expr string, expected ...string) {
+		res, err := n.Query(expr)
+		if err != nil {
+			t.Errorf("Error compiling %s: %s", expr, err)
+			return
+		}
+		var got []string
+		for _, v := range res {
+			got = append(got, v.Text())
+		}
+		if strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("Wrong result for %s, expected: %v, got: %v", expr, expected, got)
+		}
+	}
+
+	doTest("number", "1", "2", "0x3", "45")
+	doTest("/list/values/element", "1")
+	doTest("/list//element", "1", "[2,0x3]", "2", "0x3", "45")
+	doTest("/list/values//element[list]", "[2,0x3]")
+	doTest("element[list]//number", "2", "0x3")
+	doTest("values[2]")
+	doTest("digit[1]", "1", "2", "4")
+	doTest("/list/*", "1,[2,0x3],45")
+	doTest("./values/element/number", "1")
+	doTest("/values")
+	doTest("number/digit[2]", "5")
+
+	one, err := n.QueryOne("list//number")
+	if err != nil || one == nil || one.Text() != "1" {
+		t.Errorf("Wrong QueryOne result: %v %v", one, err)
+	}
+	one, _ = n.QueryOne("nothing")
+	if one != nil {
+		t.Error("QueryOne should return nil without matches")
+	}
+
+	s := mkf.MustCompileSelector("element/number")
+	if first := s.First(n.Child(1)); first == nil || first.Text() != "1" {
+		t.Error("Wrong First result")
+	}
+
+	csv := mustParse(t, "csv\n\tdigits§','\ndigits\n\t/^[0-9]+/\n", "12,34,56")
+	if d, _ := csv.QueryOne("csv/digits[2]"); d == nil || d.Text() != "34" {
+		t.Errorf("Wrong csv/digits[2]: %v", d)
+	}
+
+	for _, bad := range []string{"", "a/", "a[0]", "a[", "a]", "a b", "a///b", "[1]"} {
+		if _, err := mkf.CompileSelector(bad); err == nil {
+			t.Errorf("Expected error compiling %q", bad)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	n := mustParse(t, testPairGrammar, "ab=1")
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	var back mkf.Node
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	again, _ := json.Marshal(&back)
+	if string(again) != string(data) {
+		t.Errorf("Round trip changed the tree:\n%s\n%s", data, again)
+	}
+	if d, _ := back.QueryOne("digit"); d == nil || d.Text() != "1" || d.Start() != 3 {
+		t.Error("Decoded tree is wrong")
+	}
+
+	var sb strings.Builder
+	err = mkf.EncodeJSON(&sb, n, mkf.JSONOptions{
+		OmitAnonymousLeaves: true,
+		OmitInnerText:       true,
+	})
+	if err != nil {
+		t.Fatalf("EncodeJSON failed: %s", err)
+	}
+
+	expected := `{"rule":"pair","start":0,"end":4,"children":[` +
+		`{"rule":"key","text":"ab","start":0,"end":2},` +
+		`{"rule":"value","start":3,"end":4,"children":[` +
+		`{"rule":"","start":3,"end":4,"children":[{"rule":"digit","text":"1","start":3,"end":4}]}]}]}` + "\n"
+	if sb.String() != expected {
+		t.Errorf("Wrong compact encoding:\n%s", sb.String())
+	}
+
+	small, err := mkf.DecodeJSON(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatalf("DecodeJSON failed: %s", err)
+	}
+	if small.Text() != "ab1" || small.Len() != 2 || small.Child(1).Start() != 3 {
+		t.Errorf("Wrong decoded tree: %q %d", small.Text(), small.Len())
+	}
+
+	if _, err := mkf.DecodeJSON(strings.NewReader(`{"start":3,"end":1}`)); err == nil {
+		t.Error("Expected error for an invalid span")
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	n := mustParse(t, testListGrammar, "[1,[23]]")
+
+	rules := func(n *mkf.Node) string {
+		var ret []string
+		mkf.Walk(n, mkf.WalkFunc(func(n *mkf.Node) (bool, error) {
+			if n.Rule() == "" {
+				ret = append(ret, n.Text())
+			} else {
+				ret = append(ret, n.Rule())
+			}
+			return false, nil
+		}))
+		return strings.Join(ret, " ")
+	}
+
+	doTest := func(opts mkf.SimplifyOptions, expected string) {
+		s := mkf.Simplify(n, opts)
+		if got := rules(s); got != expected {
+			t.Errorf("Wrong tree for %+v\nexpected: %s\ngot:      %s", opts, expected, got)
+		}
+	}
+
+	doTest(mkf.SimplifyOptions{},
+		"list [ values element number digit 1 , values element list [ values element number digit 2 digit 3 ] ]")
+	doTest(mkf.SimplifyOptions{DropAnonymousLeaves: true},
+		"list values element number digit values element list values element number digit digit")
+	doTest(mkf.SimplifyOptions{DropAnonymousLeaves: true, CollapseSingleChild: true},
+		"list values digit list number digit digit")
+
+	before := rules(n)
+	mkf.Simplify(n, mkf.SimplifyOptions{DropAnonymousLeaves: true})
+	if rules(n) != before {
+		t.Error("Simplify shouldn't change the original tree")
+	}
+}
+
+type testUpper string
+
+func (u *testUpper) UnmarshalText(b []byte) error {
+	*u = testUpper(strings.ToUpper(string(b)))
+	return nil
+}
+
+func TestUnmarshal(t *testing.T) {
+	n := mustParse(t, testListGrammar, "[1,[2,0x3f],45]")
+
+	type number struct {
+		Text   string    `mkf:"."`
+		Value  int64     `mkf:"."`
+		Digits []uint16  `mkf:"digit"`
+		Bytes  []byte    `mkf:"."`
+		Node   *mkf.Node `mkf:"."`
+	}
+	type element struct {
+		Number *number  `mkf:"number"`
+		Inner  []string `mkf:"list//number"`
+	}
+	var v struct {
+		First    number      `mkf:"values/element/number"`
+		Elements []element   `mkf:"values//element"`
+		All      []int       `mkf:"//number"`
+		Upper    []testUpper `mkf:"//number"`
+		Ignored  string
+		Skipped  string `mkf:"-"`
+	}
+
+	if err := mkf.Unmarshal(n, &v); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	if v.First.Text != "1" || v.First.Value != 1 || v.First.Node == nil {
+		t.Errorf("Wrong first number: %+v", v.First)
+	}
+	if len(v.Elements) != 5 {
+		t.Fatalf("Wrong number of elements: %d", len(v.Elements))
+	}
+	if v.Elements[1].Number != nil || strings.Join(v.Elements[1].Inner, " ") != "2 0x3f" {
+		t.Errorf("Wrong nested element: %+v", v.Elements[1])
+	}
+	if e := v.Elements[3]; e.Number == nil || e.Number.Value != 63 {
+		t.Errorf("Wrong hex element: %+v", e.Number)
+	}
+	if e := v.Elements[4]; len(e.Number.Digits) != 2 || e.Number.Digits[1] != 5 {
+		t.Errorf("Wrong digits: %v", e.Number.Digits)
+	}
+	if len(v.All) != 4 || v.All[3] != 45 {
+		t.Errorf("Wrong numbers: %v", v.All)
+	}
+	if len(v.Upper) != 4 || v.Upper[2] != "0X3F" {
+		t.Errorf("TextUnmarshaler not used: %v", v.Upper)
+	}
+	if string(v.First.Bytes) != "1" {
+		t.Errorf("A []byte should get the text: %q", v.First.Bytes)
+	}
+
+	//the slices are replaced, not appended to
+	if err := mkf.Unmarshal(n, &v); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	if len(v.Elements) != 5 || len(v.All) != 4 || len(v.Elements[4].Number.Digits) != 2 {
+		t.Errorf("Unmarshaling again duplicated entries: %d %d", len(v.Elements), len(v.All))
+	}
+
+	var bad struct {
+		Number int `mkf:"//list"`
+	}
+	if err := mkf.Unmarshal(n, &bad); err == nil {
+		t.Error("Expected conversion error")
+	}
+	if err := mkf.Unmarshal(n, bad); err == nil {
+		t.Error("Expected error for a non pointer")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	n := mustParse(t, testPairGrammar, "ab=12")
+
+	sexpr := `(pair (key "ab") "=" (value (digit "1") (digit "2")))`
+	if s := fmt.Sprint(n); s != sexpr {
+		t.Errorf("Wrong S-expression:\n%s", s)
+	}
+	if s := fmt.Sprintf("%s|%q", n.Child(0), n); s != `(key "ab")|"ab=12"` {
+		t.Errorf("Wrong formatting: %s", s)
+	}
+
+	outline := `pair "ab=12" 0:5
+  key "ab" 0:2
+    "ab" 0:2
+  "=" 2:3
+  value "12" 3:5
+    _ "12" 3:5
+      digit "1" 3:4
+        "1" 3:4
+      digit "2" 4:5
+        "2" 4:5
+`
+	if s := fmt.Sprintf("%+v", n); s != outline {
+		t.Errorf("Wrong outline:\n%s", s)
+	}
+
+	var sb strings.Builder
+	if err := mkf.FormatTree(&sb, n.Child(2), mkf.StyleSExpr); err != nil {
+		t.Fatalf("FormatTree failed: %s", err)
+	}
+	if sb.String() != `(value (digit "1") (digit "2"))` {
+		t.Errorf("Wrong subtree: %s", sb.String())
+	}
+	if mkf.FormatTree(&sb, n, mkf.TreeStyle(42)) == nil {
+		t.Error("Expected error for an unknown style")
+	}
+}
+
+func TestDOT(t *testing.T) {
+	n := mustParse(t, testPairGrammar, `ab=1`)
+
+	var sb strings.Builder
+	if err := mkf.WriteDOT(&sb, n.Child(2)); err != nil {
+		t.Fatalf("WriteDOT failed: %s", err)
+	}
+	expected := `digraph parseTree {
+	node [shape=box];
+	n0 [label="value"];
+	n1 [label="_", shape=ellipse];
+	n0 -> n1;
+	n2 [label="digit"];
+	n1 -> n2;
+	n3 [label="\"1\"", shape=plaintext];
+	n2 -> n3;
+}
+`
+	if sb.String() != expected {
+		t.Errorf("Wrong parse tree graph:\n%s", sb.String())
+	}
+
+	p, err := mkf.NewParser(`
+csv
+	value§sep
+	value§','
+
+value
+	digit{1,3}
+	"none"
+
+digit
+	'0' . '9'
+
+sep
+	","
+`)
+	if err != nil {
+		t.Fatalf("Error compiling grammar: %s", err)
+	}
+
+	sb.Reset()
+	if err := p.WriteRuleGraphDOT(&sb); err != nil {
+		t.Fatalf("WriteRuleGraphDOT failed: %s", err)
+	}
+	expected = `digraph grammar {
+	node [shape=box];
+	"csv" [label="csv", peripheries=2];
+	"value" [label="value"];
+	"digit" [label="digit"];
+	"sep" [label="sep"];
+	"csv" -> "value" [label="§"];
+	"csv" -> "sep" [label="sep"];
+	"value" -> "digit" [label="{1,3}"];
+}
+`
+	if sb.String() != expected {
+		t.Errorf("Wrong rule graph:\n%s", sb.String())
+	}
+}
+
+func TestErrorNodeOutputs(t *testing.T) {
+	p, e := mkf.NewParser(testListGrammar)
+	if e != nil {
+		t.Fatalf("Error compiling grammar: %s", e)
+	}
+	p.SetRecovery(&mkf.Recovery{Literals: []string{",", "]"}})
+	n, e := p.ParseString("[1,2z,3]")
+	if e == nil {
+		t.Fatal("Expected a recovered error")
+	}
+
+	errorNodes := func(n *mkf.Node) []string {
+		var ret []string
+		mkf.Walk(n, mkf.WalkFunc(func(n *mkf.Node) (bool, error) {
+			if n.IsError() {
+				ret = append(ret, n.Text())
+			}
+			return false, nil
+		}))
+		return ret
+	}
+	if got := errorNodes(n); fmt.Sprint(got) != "[z]" {
+		t.Fatalf("Wrong error nodes: %q", got)
+	}
+
+	s := mkf.Simplify(n, mkf.SimplifyOptions{DropAnonymousLeaves: true, CollapseSingleChild: true})
+	if got := errorNodes(s); fmt.Sprint(got) != "[z]" {
+		t.Errorf("Simplify lost the error nodes: %q", got)
+	}
+	if str := s.String(); str != `(list (values (digit) (values (number (digit) (digit !"z")) (digit))))` {
+		t.Errorf("Wrong S-expression: %s", str)
+	}
+	if out := fmt.Sprintf("%+v", n); !strings.Contains(out, "\n              !\"z\" 4:5\n") {
+		t.Errorf("Wrong outline:\n%s", out)
+	}
+
+	var sb strings.Builder
+	if err := mkf.WriteDOT(&sb, s.Child(0).Child(1).Child(0).Child(1)); err != nil {
+		t.Fatalf("WriteDOT failed: %s", err)
+	}
+	expected := `digraph parseTree {
+	node [shape=box];
+	n0 [label="digit"];
+	n1 [label="!\"z\"", shape=plaintext, color=red];
+	n0 -> n1;
+}
+`
+	if sb.String() != expected {
+		t.Errorf("Wrong parse tree graph:\n%s", sb.String())
+	}
+
+	sb.Reset()
+	if err := mkf.EncodeJSON(&sb, n, mkf.JSONOptions{OmitAnonymousLeaves: true}); err != nil {
+		t.Fatalf("EncodeJSON failed: %s", err)
+	}
+	back, err := mkf.DecodeJSON(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatalf("DecodeJSON failed: %s", err)
+	}
+	if got := errorNodes(back); fmt.Sprint(got) != "[z]" {
+		t.Fatalf("The JSON lost the error nodes: %q\n%s", got, sb.String())
+	}
+	var pe *mkf.ParseError
+	if !errors.As(e, &pe) {
+		t.Fatalf("Expected a ParseError: %v", e)
+	}
+	z, _ := back.QueryOne("//digit[2]")
+	if z == nil || z.Len() != 1 || fmt.Sprint(z.Child(0).Err()) != pe.Error() {
+		t.Errorf("The decoded error is wrong: %v", z)
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	p, e := mkf.NewParser(testPairGrammar)
+	if e != nil {
+		t.Fatalf("Error compiling grammar: %s", e)
+	}
+
+	_, e = p.ParseString("abc=12x")
+	want := "expected digit at 1:7, found 'x'\n" +
+		" 1 | abc=12x\n" +
+		"   |       ^\n"
+	if got := mkf.FormatError(e, "abc=12x"); got != want {
+		t.Errorf("Wrong parse error, expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	grammar := "pair\n\tkey \"=\" value\n\nkey\n\t/^[a-z]+/ §\n"
+	_, e = mkf.NewParser(grammar)
+	want = "misuse of the § operator at 5:2\n" +
+		" 5 | \t/^[a-z]+/ §\n" +
+		"   | \t^~~~~~~~~~~\n"
+	if got := mkf.FormatError(e, grammar); got != want {
+		t.Errorf("Wrong grammar error, expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	want = "\x1b[1mmisuse of the § operator at 5:2\x1b[0m\n" +
+		" 5 |     /^[a-z]+/ §\n" +
+		"   |     \x1b[1;31m^~~~~~~~~~~\x1b[0m\n"
+	got := mkf.FormatErrorWith(e, grammar, mkf.ErrorFormatOptions{Color: true, TabWidth: 4})
+	if got != want {
+		t.Errorf("Wrong colored error, expected:\n%q\ngot:\n%q", want, got)
+	}
+
+	//a list writes every error
+	grammar = "pair\n\tkey \"=\" missing\n\nkey\n\t/x/\n"
+	_, e = mkf.NewParserAllErrors(grammar)
+	want = "rule not found: missing at 2:10\n" +
+		" 2 | \tkey \"=\" missing\n" +
+		"   | \t        ^~~~~~~\n" +
+		"regexes must be anchored at the begining (^) at 5:2\n" +
+		" 5 | \t/x/\n" +
+		"   | \t^~~\n"
+	if got := mkf.FormatError(e, grammar); got != want {
+		t.Errorf("Wrong error list, expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	//the end of the input is marked after the last rune
+	_, e = p.ParseString("abc=")
+	want = "expected value at 1:5, found end of input\n" +
+		" 1 | abc=\n" +
+		"   |     ^\n"
+	if got := mkf.FormatError(e, "abc="); got != want {
+		t.Errorf("Wrong error at the end, expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	if got := mkf.FormatError(errors.New("oops"), ""); got != "oops\n" {
+		t.Errorf("Errors without a position only have the message: %q", got)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// NewLineIndex indexes the lines of src
+func NewLineIndex(src string) *LineIndex {
+	lines := []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+
+	return &LineIndex{
+		src:   src,
+		lines: lines,
+	}
+}
+
+// Position resolves a byte offset, offsets out of the source are clamped
+func (li *LineIndex) Position(offset int) Position {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(li.src) {
+		offset = len(li.src)
+	}
+
+	l := sort.Search(len(li.lines), func(i int) bool {
+		return li.lines[i] > offset
+	}) - 1
+	ls := li.lines[l]
+
+	return Position{
+		Offset:     offset,
+		Line:       l + 1,
+		Column:     utf8.RuneCountInString(li.src[ls:offset]) + 1,
+		ByteColumn: offset - ls + 1,
+	}
+}
+
+// Line returns the text of a line (starting at 1) without the line break
+func (li *LineIndex) Line(line int) string {
+	if line < 1 || line > len(li.lines) {
+		return ""
+	}
+
+	s := li.src[li.lines[line-1]:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSuffix(s, "\r")
+}
+
+// Lines returns how many lines the source has
+func (li *LineIndex) Lines() int {
+	return len(li.lines)
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The error recovery parses the input again and again. After each failure
+// the text from the furthest failure to the next sync point becomes a
+// region, in the next attempt an item that fails where a region starts
+// gets an error node covering the region. The item is tried again after
+// the error, if it still fails the error takes its place. Only the items
+// of a rule that fails without errors get them, first just those of the
+// deepest rule that failed there, then those of any rule. A region that
+// didn't help grows up to the next sync point.
+
+// SetRecovery turns the error recovery of ParseString, ParseContext
+// and Evaluate on, nil turns it off
+//
+// With recovery a parse that fails still returns a tree, with error nodes
+// over the text that had to be skipped, and a ParseErrorList with every
+// error found. Each error costs one more parse of the whole input
+func (p *Parser) SetRecovery(r *Recovery) error {
+	if r == nil {
+		p.recovery = nil
+		return nil
+	}
+
+	for _, v := range r.Rules {
+		if _, ok := p.byName[v]; !ok {
+			return fmt.Errorf("rule not found: %s", v)
+		}
+	}
+
+	rc := Recovery{
+		Literals: append([]string(nil), r.Literals...),
+		Rules:    append([]string(nil), r.Rules...),
+	}
+	p.recovery = &rc
+	return nil
+}
+
+func (pe *parseEnviroment) recover() (*Node, error) {
+	p := pe.parser
+	root := p.rules[p.root].name
+	input := pe.input
+
+	regions := map[int]*recoveryRegion{}
+	var errs ParseErrorList
+
+	for {
+		try := parseEnviroment{
+			parser:  p,
+			ctx:     pe.ctx,
+			input:   input,
+			regions: regions,
+		}
+
+		n, ok := try.matchRule(root, input)
+		if try.err != nil {
+			return nil, try.err
+		}
+		if ok && len(n.val) == len(input) {
+			return n, errs.result()
+		}
+		if ok && try.fail.pos < len(n.val) {
+			//nothing failed after the end of the root, it just stopped there
+			try.fail = failure{pos: len(n.val)}
+			errs = append(errs, try.parseError())
+			return trailingError(n, input, errs[len(errs)-1]), errs.result()
+		}
+
+		perr := try.parseError()
+		from := try.fail.pos
+		r, seen := regions[from]
+		switch {
+		case !seen:
+			errs = append(errs, perr)
+			regions[from] = &recoveryRegion{
+				end:  try.syncPoint(from),
+				err:  perr,
+				rule: try.fail.rule,
+			}
+		case r.rule != "":
+			//the deepest rule that failed wasn't the right spot
+			r.rule = ""
+		case r.end < len(input):
+			//it didn't help, skip more
+			_, l := utf8.DecodeRuneInString(input[r.end:])
+			r.end = try.syncPoint(r.end + l)
+		case ok:
+			return trailingError(n, input, r.err), errs.result()
+		default:
+			//nothing is left to skip, the whole input is wrong
+			return &Node{
+				rule: root,
+				val:  input,
+				end:  len(input),
+				err:  errs[0],
+			}, errs.result()
+		}
+	}
+}
+
+// trailingError puts the input after the end of the root in an error node
+func trailingError(n *Node, input string, err *ParseError) *Node {
+	n.childs = append(n.childs, &Node{
+		val:   input[len(n.val):],
+		start: len(n.val),
+		end:   len(input),
+		err:   err,
+	})
+	n.val = input
+	n.end = len(input)
+	return n
+}
+
+// syncPoint returns the first offset, from the given one, where
+// the parse can be picked up again, or the end of the input
+func (pe *parseEnviroment) syncPoint(from int) int {
+	rc := pe.parser.recovery
+	probe := parseEnviroment{
+		parser: pe.parser,
+		input:  pe.input,
+		quiet:  1,
+	}
+
+	for off := from; off < len(pe.input); {
+		s := pe.input[off:]
+		for _, v := range rc.Literals {
+			if strings.HasPrefix(s, v) {
+				return off
+			}
+		}
+		for _, v := range rc.Rules {
+			if _, ok := probe.matchRule(v, s); ok {
+				return off
+			}
+		}
+
+		_, l := utf8.DecodeRuneInString(s)
+		off += l
+	}
+	return len(pe.input)
+}
+
+// reentered reports if the rule is already being matched at the offset,
+// error nodes can match nothing and make any rule left recursive
+func (pe *parseEnviroment) reentered(rule string, off int) bool {
+	for f := pe.stack; f != nil && f.off == off; f = f.up {
+		if f.rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// errorNode returns a node for the region starting at s, nil if there is none
+func (pe *parseEnviroment) errorNode(s string) *Node {
+	if pe.regions == nil || pe.quiet > 0 {
+		return nil
+	}
+
+	r, ok := pe.regions[pe.offset(s)]
+	if !ok {
+		return nil
+	}
+	if r.rule != "" && r.rule != pe.stack.rule {
+		return nil
+	}
+	if !pe.skip {
+		pe.missed = true
+		return nil
+	}
+	return &Node{
+		val: s[:r.end-pe.offset(s)],
+		err: r.err,
+	}
+}
+
+// result returns the list as an error, nil if it is empty
+func (l ParseErrorList) result() error {
+	if len(l) == 0 {
+		return nil
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].Pos.Offset < l[j].Pos.Offset
+	})
+	return l
+}
@@ -0,0 +1,260 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	selName  = regexp.MustCompile(`^([a-zA-Z_]+|\*)`)
+	selIndex = regexp.MustCompile(`^\[(\d+)\]`)
+	selHas   = regexp.MustCompile(`^\[([a-zA-Z_]+)\]`)
+)
+
+// CompileSelector compiles a path expression over rule names, like
+//
+//	array/values//arrElement[hexValue]
+//	csv/digits[2]
+//
+// "a/b" selects the b nodes that are children of an a node and "a//b"
+// the ones that are descendants of it, "*" matches any rule.
+// Only named nodes are considered, anonymous ones (literals, repetitions...)
+// are looked through, so the children of a node are the closest named
+// nodes below it.
+//
+// Predicates filter a step: [n] keeps the n-th match (starting at 1) among
+// the ones sharing a parent and [rule] keeps the nodes having a child of
+// that rule, so "//digit[1]" is the first digit of every number.
+//
+// The first step matches the node the selector is applied to or any
+// of its descendants, starting with "/" it only matches the node itself
+// and starting with "./" only its children
+func CompileSelector(expr string) (*Selector, error) {
+	s := expr
+	first := axisDescendantOrSelf
+	switch {
+	case strings.HasPrefix(s, "./"):
+		first = axisChild
+		s = s[2:]
+	case strings.HasPrefix(s, "//"):
+		s = s[2:]
+	case strings.HasPrefix(s, "/"):
+		first = axisSelf
+		s = s[1:]
+	}
+
+	fail := func(msg string) (*Selector, error) {
+		col := len(expr) - len(s)
+		return nil, fmt.Errorf("invalid selector %q at column %d: %s", expr, col, msg)
+	}
+
+	var steps []selStep
+	axis := first
+	for {
+		name, rest, ok := consumeRegex(s, selName)
+		if !ok {
+			return fail("expected rule name")
+		}
+		s = rest
+
+		st := selStep{
+			name: name,
+			axis: axis,
+		}
+
+		for strings.HasPrefix(s, "[") {
+			if n, rest, ok := consumeRegex(s, selIndex); ok {
+				i, err := strconv.Atoi(n)
+				if err != nil || i == 0 {
+					return fail("invalid index")
+				}
+				st.preds = append(st.preds, selPred{index: i})
+				s = rest
+				continue
+			}
+			if n, rest, ok := consumeRegex(s, selHas); ok {
+				st.preds = append(st.preds, selPred{rule: n})
+				s = rest
+				continue
+			}
+			return fail("invalid predicate")
+		}
+
+		steps = append(steps, st)
+
+		switch {
+		case s == "":
+			return &Selector{
+				expr:  expr,
+				steps: steps,
+			}, nil
+		case strings.HasPrefix(s, "//"):
+			axis = axisDescendant
+			s = s[2:]
+		case strings.HasPrefix(s, "/"):
+			axis = axisChild
+			s = s[1:]
+		default:
+			return fail("unexpected character")
+		}
+	}
+}
+
+// MustCompileSelector is like CompileSelector but panics on errors
+func MustCompileSelector(expr string) *Selector {
+	s, err := CompileSelector(expr)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (s *Selector) String() string {
+	return s.expr
+}
+
+// Match returns every node selected from n, in the order they appear
+func (s *Selector) Match(n *Node) []*Node {
+	if n == nil {
+		return nil
+	}
+
+	curr := []*Node{n}
+	for _, st := range s.steps {
+		var next []*Node
+		seen := map[*Node]bool{}
+
+		for _, c := range curr {
+			for _, v := range st.apply(c) {
+				if !seen[v] {
+					seen[v] = true
+					next = append(next, v)
+				}
+			}
+		}
+
+		curr = next
+	}
+
+	return curr
+}
+
+// First returns the first node selected from n, or nil
+func (s *Selector) First(n *Node) *Node {
+	if m := s.Match(n); len(m) > 0 {
+		return m[0]
+	}
+	return nil
+}
+
+// Query compiles expr and returns the nodes it selects from n
+func (n *Node) Query(expr string) ([]*Node, error) {
+	s, err := CompileSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Match(n), nil
+}
+
+// QueryOne is like Query, but only returns the first node (or nil)
+func (n *Node) QueryOne(expr string) (*Node, error) {
+	s, err := CompileSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	return s.First(n), nil
+}
+
+func (st *selStep) apply(n *Node) []*Node {
+	switch st.axis {
+	case axisSelf:
+		return st.filter([]*Node{n})
+	case axisChild:
+		return st.filter(ruleChildren(n, nil))
+	}
+
+	//descendants are the children of every node below,
+	//so the predicates still work relative to each parent
+	var ret []*Node
+	if st.axis == axisDescendantOrSelf {
+		ret = st.filter([]*Node{n})
+	}
+	ret = append(ret, st.filter(ruleChildren(n, nil))...)
+	for _, d := range ruleDescendants(n, nil) {
+		ret = append(ret, st.filter(ruleChildren(d, nil))...)
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		return a.end > b.end
+	})
+	return ret
+}
+
+// filter applies the name test and the predicates to the
+// candidates for a single parent
+func (st *selStep) filter(cands []*Node) []*Node {
+	var ret []*Node
+	for _, v := range cands {
+		if v.rule != "" && (st.name == "*" || st.name == v.rule) {
+			ret = append(ret, v)
+		}
+	}
+
+	for _, p := range st.preds {
+		if p.index != 0 {
+			if p.index > len(ret) {
+				return nil
+			}
+			ret = ret[p.index-1 : p.index]
+			continue
+		}
+
+		var filtered []*Node
+		for _, v := range ret {
+			for _, c := range ruleChildren(v, nil) {
+				if c.rule == p.rule {
+					filtered = append(filtered, v)
+					break
+				}
+			}
+		}
+		ret = filtered
+	}
+
+	return ret
+}
+
+// ruleChildren appends the closest named nodes below n
+func ruleChildren(n *Node, ret []*Node) []*Node {
+	for _, c := range n.childs {
+		if c.rule != "" {
+			ret = append(ret, c)
+		} else {
+			ret = ruleChildren(c, ret)
+		}
+	}
+	return ret
+}
+
+// ruleDescendants appends every named node below n
+func ruleDescendants(n *Node, ret []*Node) []*Node {
+	Walk(n, WalkFunc(func(c *Node) (bool, error) {
+		if c != n && c.rule != "" {
+			ret = append(ret, c)
+		}
+		return false, nil
+	}))
+	return ret
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+// Simplify returns a copy of the tree without the anonymous wrappers,
+// the nodes made by repetitions (digit+) and separated lists (digit§',')
+// are flattened into their parents so the tree looks like the grammar
+//
+// the original tree is not modified and the error nodes
+// made by the recovery are always kept
+func Simplify(n *Node, opts SimplifyOptions) *Node {
+	if n == nil {
+		return nil
+	}
+
+	ret := &Node{
+		rule:  n.rule,
+		val:   n.val,
+		start: n.start,
+		end:   n.end,
+		err:   n.err,
+	}
+	ret.childs = simplifyChildren(n, opts, nil)
+
+	for opts.CollapseSingleChild && ret.rule != "" && len(ret.childs) == 1 {
+		c := ret.childs[0]
+		if c.rule == "" || c.start != ret.start || c.end != ret.end {
+			break
+		}
+		ret = c
+	}
+
+	return ret
+}
+
+func simplifyChildren(n *Node, opts SimplifyOptions, dst []*Node) []*Node {
+	for _, c := range n.childs {
+		switch {
+		case c.rule == "" && len(c.childs) > 0:
+			dst = simplifyChildren(c, opts, dst)
+		case c.rule == "" && c.err == nil && opts.DropAnonymousLeaves:
+			//nothing to see here
+		default:
+			dst = append(dst, Simplify(c, opts))
+		}
+	}
+	return dst
+}
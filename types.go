@@ -5,22 +5,69 @@
 
 package mkf
 
-import "regexp"
+import (
+	"context"
+	"io"
+	"regexp"
+)
 
 type Parser struct {
-	byName map[string]*rule
-	rules  []rule
-	root   int
+	byName   map[string]*rule
+	actions  map[string]ActionFunc
+	rules    []rule
+	root     int
+	memoize  bool
+	choice   Choice
+	maxDepth int
+	utf8Mode UTF8Mode
+	recovery *Recovery
 }
 
 type rule struct {
 	name         string
 	alternatives []alternative
 	allowEmpty   bool
+	leftRec      bool //part of a left recursive cycle
+	choice       Choice
+	line         int //where it is defined, from 1
+}
+
+// Choice is how a rule picks between alternatives that match
+//
+// Whatever the policy, an empty first alternative ("") is only a fallback:
+// it is tried last, when no other alternative matches
+type Choice int8
+
+const (
+	// ChoiceDefault uses the parser policy
+	ChoiceDefault Choice = iota
+
+	// ChoiceLongest tries every alternative and keeps the longest match,
+	// on ties the later alternative wins
+	ChoiceLongest
+
+	// ChoiceFirst is the PEG ordered choice, the first alternative
+	// that matches wins and the others aren't even tried, except
+	// for an empty first alternative that still goes last
+	ChoiceFirst
+
+	// ChoiceLongestFirstTie is like ChoiceLongest but on ties
+	// the earlier alternative wins
+	ChoiceLongestFirstTie
+)
+
+// RuleInfo describes a compiled rule
+type RuleInfo struct {
+	Name          string
+	Alternatives  int
+	AllowEmpty    bool //the first alternative is ""
+	LeftRecursive bool
+	Choice        Choice //never ChoiceDefault
 }
 
 type alternative struct {
 	itens []item
+	refs  []altToken //the rules it references, for the errors
 }
 
 type cMatcher interface {
@@ -34,6 +81,7 @@ type item struct {
 
 	runes runeRange
 	kind  itemKind
+	fold  bool //case insensitive
 }
 
 type itemKind int8
@@ -46,13 +94,9 @@ const (
 	itemComplexRange
 	itemComplex
 	itemRule
+	itemLookahead
 )
 
-type grammarParseError struct {
-	err  string
-	line int
-}
-
 type complexRange struct {
 	excludes []runeRange
 	base     runeRange
@@ -64,11 +108,92 @@ type Node struct {
 	rule   string
 	val    string
 	childs []*Node
+	start  int
+	end    int
+
+	value    any //only used by Evaluate
+	hasValue bool
+
+	err *ParseError //only on the nodes made by the error recovery
 }
 
 type parseEnviroment struct {
 	parser *Parser
-	depth  int //TODO actually use this
+	ctx    context.Context //nil if it can't be cancelled
+	memo   map[memoKey]memoEntry
+	input  string
+	err    error //aborts the whole parse
+	depth  int
+	steps  int //for the context checks
+
+	stack *ruleFrame //rules being matched
+	fail  failure
+	quiet int //inside predicates failures aren't recorded
+
+	regions map[int]*recoveryRegion //by the offset where they start
+	skip    bool                    //the items of the current rule may get error nodes
+	missed  bool                    //an item of the current rule failed where a region starts
+
+	lrMemo  map[memoKey]*lrEntry //left recursive rules, even without memoization
+	heads   map[int]*lrHead      //cycles being grown, by offset
+	lrStack *lrFrame             //left recursive rules being matched
+}
+
+// lrEntry is the result of a left recursive rule,
+// lr is set while the rule is still looking for its seed
+type lrEntry struct {
+	node *Node
+	ok   bool
+	lr   *lrFrame
+}
+
+// lrFrame is a left recursive rule looking for its seed
+type lrFrame struct {
+	rule string
+	node *Node //the seed
+	ok   bool
+	head *lrHead
+	up   *lrFrame
+}
+
+// lrHead is the rule growing a cycle at some offset
+type lrHead struct {
+	rule     string
+	involved map[string]bool
+	eval     map[string]bool //still to match again in this round
+}
+
+// recoveryRegion is some input skipped by the error recovery
+type recoveryRegion struct {
+	end  int
+	err  *ParseError
+	rule string //the error nodes go in this rule, or in any one if empty
+}
+
+// failure is the furthest point where the matchers failed
+type failure struct {
+	pos      int
+	expected []string
+	stack    *ruleFrame
+	rule     string //the deepest rule that failed there, if any
+}
+
+// ruleFrame is a persistent stack of the rules being matched,
+// failures keep it without copying
+type ruleFrame struct {
+	rule string
+	off  int
+	up   *ruleFrame
+}
+
+type memoKey struct {
+	rule   string
+	offset int
+}
+
+type memoEntry struct {
+	node *Node
+	ok   bool
 }
 
 type cplxRegex regexp.Regexp
@@ -83,8 +208,298 @@ type ruleRange struct {
 	ran  [2]int32
 }
 
+// lookahead is a &thing or !thing predicate, it never consumes input
+type lookahead struct {
+	it  item
+	neg bool
+}
+
 type bunchOfNodes struct {
-	ns []*Node
-	in string
-	nm int
+	ns    []*Node
+	in    string
+	nm    int
+	start int
+}
+
+// Position is a location in some source text
+type Position struct {
+	Offset     int //in bytes, starting at 0
+	Line       int //starting at 1
+	Column     int //in runes, starting at 1
+	ByteColumn int //in bytes, starting at 1
+}
+
+// LineIndex maps byte offsets to lines and columns,
+// it's built once so each lookup is just a binary search
+type LineIndex struct {
+	src   string
+	lines []int //offset where each line starts
+}
+
+// Visitor is what Walk calls for each node of a tree
+type Visitor interface {
+	// Enter is called before visiting the children of n,
+	// returning true skips them
+	Enter(n *Node) (skipChildren bool, err error)
+
+	// Exit is called after the children of n were visited (or skipped)
+	Exit(n *Node) error
+}
+
+// WalkFunc is a Visitor that only cares about entering nodes
+type WalkFunc func(n *Node) (skipChildren bool, err error)
+
+// Selector is a compiled path expression, see CompileSelector
+type Selector struct {
+	expr  string
+	steps []selStep
+}
+
+type selAxis int8
+
+const (
+	axisDescendantOrSelf selAxis = iota
+	axisSelf
+	axisChild
+	axisDescendant
+)
+
+type selStep struct {
+	name  string //"*" matches any rule
+	preds []selPred
+	axis  selAxis
+}
+
+type selPred struct {
+	rule  string //has a child with this rule
+	index int    //starting at 1, 0 when rule is used
+}
+
+// JSONOptions controls how EncodeJSON writes a tree
+type JSONOptions struct {
+	// OmitAnonymousLeaves drops the leaves without a rule name,
+	// like literals and rune ranges, but not the error nodes
+	OmitAnonymousLeaves bool
+
+	// OmitInnerText only writes the text of the nodes written
+	// without children
+	OmitInnerText bool
+}
+
+type jsonNode struct {
+	Rule     string      `json:"rule"`
+	Text     *string     `json:"text,omitempty"`
+	Start    int         `json:"start"`
+	End      int         `json:"end"`
+	Children []*jsonNode `json:"children,omitempty"`
+	Error    *jsonError  `json:"error,omitempty"`
+}
+
+// jsonError is the ParseError of an error node
+type jsonError struct {
+	Offset     int      `json:"offset"`
+	Line       int      `json:"line"`
+	Column     int      `json:"column"`
+	ByteColumn int      `json:"byteColumn"`
+	Expected   []string `json:"expected,omitempty"`
+	Found      string   `json:"found,omitempty"`
+	Stack      []string `json:"stack,omitempty"`
+}
+
+// SimplifyOptions controls what Simplify removes besides
+// the anonymous wrappers
+type SimplifyOptions struct {
+	// DropAnonymousLeaves removes literals, rune ranges and
+	// other leaves without a rule name
+	DropAnonymousLeaves bool
+
+	// CollapseSingleChild replaces a named node by its only child
+	// when the child is also named and matched the same text
+	CollapseSingleChild bool
+}
+
+// ErrorFormatOptions controls how FormatErrorWith writes errors
+type ErrorFormatOptions struct {
+	// Color highlights the message and the marker with ANSI escapes
+	Color bool
+
+	// TabWidth expands the tabs of the source line to that many
+	// columns, with 0 they are kept and copied to the marker line
+	TabWidth int
+}
+
+// errorSpan is where an error points, line 0 if it doesn't
+type errorSpan struct {
+	msg              string
+	line, col, width int
+}
+
+// ActionFunc computes the value of a node matched by a rule, kids has the
+// values of its children and n keeps its whole subtree, see Parser.Evaluate
+type ActionFunc func(n *Node, kids []any) (any, error)
+
+// UTF8Mode is how rune ranges deal with input that isn't valid UTF-8
+type UTF8Mode int8
+
+const (
+	// UTF8Replace decodes each invalid byte as utf8.RuneError (U+FFFD),
+	// so ranges including it match garbage
+	UTF8Replace UTF8Mode = iota
+
+	// UTF8Strict refuses inputs that aren't valid UTF-8,
+	// parsing fails with an *EncodingError
+	UTF8Strict
+
+	// UTF8Raw doesn't decode anything, rune ranges match single
+	// bytes, so '0080' . '00FF' matches any byte above 0x7F
+	UTF8Raw
+)
+
+// GrammarError describes a problem in the grammar given to NewParser
+type GrammarError struct {
+	Code GrammarErrorCode
+	Msg  string
+	// Line and Column start at 1, the column counts runes, they are 0
+	// when the problem isn't in a specific place
+	Line, Column int
+	// Rule is the rule being defined, if any
+	Rule string
+	// Snippet is the offending part of the grammar
+	Snippet string
+	// Err is what caused the problem, like a regexp error
+	Err error
+}
+
+// ErrorList is every problem found by NewParserAllErrors
+type ErrorList []*GrammarError
+
+// GrammarErrorCode identifies a kind of GrammarError,
+// the codes don't change between versions
+type GrammarErrorCode string
+
+// ParseError is returned when the input doesn't match the grammar,
+// it describes the furthest point the matchers reached
+type ParseError struct {
+	Pos Position
+	// Expected is what would be accepted at Pos, written like in the
+	// grammar: "lit", 'a'..'z', /^regex/ and rule names, when it is
+	// empty the root rule matched and the input didn't end
+	Expected []string
+	// Found is the rune at Pos, "" at the end of the input
+	Found string
+	// Stack has the rules being matched at Pos, the root first
+	Stack []string
+}
+
+// ParseErrorList is every error found by the error recovery
+type ParseErrorList []*ParseError
+
+// Recovery says where the error recovery may pick up the parse again,
+// right before any of the literals or where any of the rules match
+type Recovery struct {
+	Literals []string
+	Rules    []string
+}
+
+// EncodingError is returned in strict mode for inputs that aren't valid UTF-8
+type EncodingError struct {
+	Pos Position //of the first invalid byte
+}
+
+// DepthError is returned when rules nest deeper than the parser allows,
+// it matches ErrDepthExceeded with errors.Is
+type DepthError struct {
+	Rule string //the rule that went too deep
+	Max  int
+	Pos  Position
+}
+
+// ActionError is returned by Evaluate when an action fails
+type ActionError struct {
+	Err  error
+	Rule string
+	Pos  Position
+}
+
+// TreeStyle selects how FormatTree writes a tree
+type TreeStyle int8
+
+const (
+	// StyleSExpr is a compact one line S-expression like
+	// (array "[" (values ...) "]"), stable enough for golden tests
+	StyleSExpr TreeStyle = iota
+
+	// StyleOutline writes one node per line, indented by depth,
+	// with the rule name, the quoted text and the span
+	StyleOutline
+)
+
+type treeWriter struct {
+	w   io.Writer
+	err error
+}
+
+// visitorFuncs is a Visitor made of closures
+type visitorFuncs struct {
+	enter func(*Node) (bool, error)
+	exit  func(*Node) error
+}
+
+// Forest is a shared packed parse forest holding every derivation of
+// an input, subtrees common to several derivations are stored once
+type Forest struct {
+	root  *forestNode
+	input string
+}
+
+type forestNode struct {
+	packs    [][]*forestNode //each way the node can be derived
+	packKeys map[string]bool
+	rule     string //"" for anonymous nodes
+	start    int
+	end      int
+	id       int
+	leaf     bool
+	chain    int32 //not 0 for the inner nodes of repetitions and lists
+}
+
+type forestKey struct {
+	it    *item //nil for rule nodes
+	rule  string
+	start int
+	end   int
+	chain int32 //how many rules an inner node of a repetition has
+}
+
+type forestEntry struct {
+	nodes []*forestNode //one for each end
+	done  bool
+	busy  bool
+}
+
+type forestEnviroment struct {
+	pe      *parseEnviroment
+	nodes   map[forestKey]*forestNode
+	rules   map[memoKey]*forestEntry
+	growing map[int]int //left recursive rules growing at each offset
+	changed bool
+}
+
+type seqMatch struct {
+	kids []*forestNode
+	end  int
+}
+
+// TreeIterator goes through the trees of a Forest, see Forest.Trees
+type TreeIterator struct {
+	forest  *Forest
+	tree    *Node
+	choices []treeChoice //the packs picked for the current tree
+	next    int          //the next choice to be made while building
+	started bool
+	done    bool
+}
+
+type treeChoice struct {
+	n, of int
 }
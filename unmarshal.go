@@ -0,0 +1,193 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	nodePtrType = reflect.TypeOf((*Node)(nil))
+	textUnmType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+	tagSelectors sync.Map //tag -> *Selector
+)
+
+// Unmarshal fills v, which must be a non-nil pointer, from the tree rooted at n
+//
+// Struct fields are filled from the nodes selected by their mkf tag,
+// the tag is a selector (see CompileSelector) relative to the children
+// of the struct node, so `mkf:"decValue"` is a child and
+// `mkf:"values//arrElement"` a descendant of a values child,
+// the tag "." selects the node itself
+//
+// Slices are emptied and then collect every selected node, other kinds only
+// take the first one and are left untouched when nothing is selected.
+// A []byte isn't a slice here, it gets the text like a string. Structs
+// recurse into the selected node, *Node fields get the node itself and
+// everything else is converted from the node text, using
+// encoding.TextUnmarshaler when available and strconv otherwise
+// (integers accept the 0x, 0o and 0b prefixes)
+func Unmarshal(n *Node, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("Unmarshal needs a non-nil pointer, got %T", v)
+	}
+	if n == nil {
+		return fmt.Errorf("Unmarshal of a nil node")
+	}
+
+	return unmarshalValue(n, rv.Elem())
+}
+
+func unmarshalValue(n *Node, v reflect.Value) error {
+	t := v.Type()
+
+	if t == nodePtrType {
+		v.Set(reflect.ValueOf(n))
+		return nil
+	}
+
+	if reflect.PointerTo(t).Implements(textUnmType) {
+		tu := v.Addr().Interface().(encoding.TextUnmarshaler)
+		return tu.UnmarshalText([]byte(n.val))
+	}
+
+	txt := n.val
+	var err error
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return unmarshalValue(n, v.Elem())
+
+	case reflect.Struct:
+		return unmarshalStruct(n, v)
+
+	case reflect.String:
+		v.SetString(txt)
+
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("can't unmarshal into %s", t)
+		}
+		v.SetBytes([]byte(txt))
+
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return fmt.Errorf("can't unmarshal into %s", t)
+		}
+		v.Set(reflect.ValueOf(txt))
+
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(txt)
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(txt, 0, t.Bits())
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		u, err = strconv.ParseUint(txt, 0, t.Bits())
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(txt, t.Bits())
+		v.SetFloat(f)
+
+	default:
+		return fmt.Errorf("can't unmarshal into %s", t)
+	}
+
+	if err != nil {
+		return fmt.Errorf("can't convert %q (%s at offset %d) into %s: %w",
+			txt, n.rule, n.start, t, err)
+	}
+	return nil
+}
+
+func unmarshalStruct(n *Node, v reflect.Value) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("mkf")
+
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		if !tagged {
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				if err := unmarshalStruct(n, v.Field(i)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var matches []*Node
+		if tag == "." {
+			matches = []*Node{n}
+		} else {
+			sel, err := tagSelector(tag)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", f.Name, err)
+			}
+			matches = sel.Match(n)
+		}
+
+		fv := v.Field(i)
+		if f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() != reflect.Uint8 {
+			fv.Set(fv.Slice(0, 0))
+			for _, m := range matches {
+				ev := reflect.New(f.Type.Elem()).Elem()
+				if err := unmarshalValue(m, ev); err != nil {
+					return fmt.Errorf("field %s: %w", f.Name, err)
+				}
+				fv.Set(reflect.Append(fv, ev))
+			}
+			continue
+		}
+
+		if len(matches) == 0 {
+			continue
+		}
+		if err := unmarshalValue(matches[0], fv); err != nil {
+			return fmt.Errorf("field %s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func tagSelector(tag string) (*Selector, error) {
+	if s, ok := tagSelectors.Load(tag); ok {
+		return s.(*Selector), nil
+	}
+
+	expr := tag
+	if !strings.HasPrefix(tag, "/") && !strings.HasPrefix(tag, ".") {
+		expr = "./" + tag
+	}
+
+	s, err := CompileSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	tagSelectors.Store(tag, s)
+	return s, nil
+}
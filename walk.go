@@ -0,0 +1,67 @@
+// Copyright 2023 - Harrison Ferreira. All rights reserved.
+
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mkf
+
+import "errors"
+
+// SkipAll can be returned by a visitor to stop the walk, even wrapped,
+// Walk then returns nil
+var SkipAll = errors.New("skip all the remaining nodes")
+
+// Walk traverses the tree rooted at n depth-first, the first error
+// returned by the visitor stops the walk and is returned
+//
+// it doesn't recurse, so it works with trees of any depth
+func Walk(n *Node, v Visitor) error {
+	if n == nil {
+		return nil
+	}
+
+	type frame struct {
+		n    *Node
+		next int
+	}
+
+	var stack []frame
+	enter := func(n *Node) error {
+		skip, err := v.Enter(n)
+		if err != nil {
+			return err
+		}
+		if skip {
+			return v.Exit(n)
+		}
+		stack = append(stack, frame{n: n})
+		return nil
+	}
+
+	err := enter(n)
+	for err == nil && len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == len(top.n.childs) {
+			stack = stack[:len(stack)-1]
+			err = v.Exit(top.n)
+			continue
+		}
+
+		c := top.n.childs[top.next]
+		top.next++
+		err = enter(c)
+	}
+
+	if errors.Is(err, SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func (f WalkFunc) Enter(n *Node) (bool, error) {
+	return f(n)
+}
+
+func (f WalkFunc) Exit(*Node) error {
+	return nil
+}